@@ -0,0 +1,221 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DirBlobStore stores blobs as the files of a local directory.
+// Keys are slash-separated paths relative to the directory.
+type DirBlobStore struct {
+	Dir string
+}
+
+func NewDirBlobStore(dir string) *DirBlobStore {
+	return &DirBlobStore{Dir: dir}
+}
+
+func (s *DirBlobStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s *DirBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *DirBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrBlobNotFound, err)
+	}
+	return f, err
+}
+
+// Create returns a writer of a temporary file, which is renamed to the blob on Close
+func (s *DirBlobStore) Create(ctx context.Context, key string) (BlobWriter, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirBlobWriter{File: f, path: path}, nil
+}
+
+func (s *DirBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the keys which start with the prefix, except the temporary files being written
+func (s *DirBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *DirBlobStore) Location(key string) string {
+	return s.path(key)
+}
+
+type dirBlobWriter struct {
+	*os.File
+	path    string
+	aborted bool
+}
+
+func (w *dirBlobWriter) Close() error {
+	if w.aborted {
+		return nil
+	}
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *dirBlobWriter) Abort() error {
+	w.aborted = true
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// MemoryBlobStore stores blobs in memory. It is useful for tests.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: map[string][]byte{}}
+}
+
+func (s *MemoryBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[key]
+	return ok, nil
+}
+
+func (s *MemoryBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrBlobNotFound, s.Location(key))
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *MemoryBlobStore) Create(ctx context.Context, key string) (BlobWriter, error) {
+	return &memoryBlobWriter{store: s, key: key}, nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *MemoryBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *MemoryBlobStore) Location(key string) string {
+	return "mem://" + key
+}
+
+type memoryBlobWriter struct {
+	store *MemoryBlobStore
+	key   string
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	aborted bool
+}
+
+func (w *memoryBlobWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.aborted {
+		return 0, errBlobAborted
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryBlobWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.aborted {
+		return nil
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.blobs[w.key] = append([]byte{}, w.buf.Bytes()...)
+	return nil
+}
+
+func (w *memoryBlobWriter) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.aborted = true
+	return nil
+}
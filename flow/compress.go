@@ -0,0 +1,226 @@
+package flow
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// NoCompression writes and reads the records as they are
+	NoCompression Compression = noCompression{}
+	// Gzip compresses the records by gzip. It is used by default for the paths with ".gz" extension.
+	Gzip Compression = gzipCompression{}
+	// Zstd compresses the records by zstd. It is used by default for the paths with ".zst" extension.
+	Zstd Compression = zstdCompression{}
+)
+
+var errTailCanceled = errors.New("tail is canceled")
+
+// Compression compresses the records written to a file or an object, and decompresses them on read
+type Compression interface {
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type noCompression struct{}
+
+func (noCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type gzipCompression struct{}
+
+func (gzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCompression struct{}
+
+func (zstdCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// compressionOf returns the compression detected from the extension of the path
+func compressionOf(path string) Compression {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return Gzip
+	case ".zst":
+		return Zstd
+	default:
+		return NoCompression
+	}
+}
+
+// fileWriter writes the records to a file or an upload stream through the compression
+type fileWriter struct {
+	f     io.WriteCloser
+	w     io.WriteCloser
+	flush bool
+}
+
+// newFileWriter wraps f by the compression, and writes the header record of the serializer.
+// If flush is true, each record is flushed so that the readers can tail the file.
+// f is not closed on error.
+func newFileWriter(f io.WriteCloser, srz *Serializer, c Compression, flush bool) (*fileWriter, error) {
+	w, err := c.NewWriter(f)
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWriter{f: f, w: w, flush: flush}
+	if srz.Header != nil {
+		if err := fw.Write(srz.framing().Frame(append([]byte{}, srz.Header...))); err != nil {
+			return nil, err
+		}
+	}
+	return fw, nil
+}
+
+// createFile creates a file and writes the header record to it
+func createFile(path string, srz *Serializer, c Compression, flush bool) (*fileWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := newFileWriter(f, srz, c, flush)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fw, nil
+}
+
+func (fw *fileWriter) Write(b []byte) error {
+	if _, err := fw.w.Write(b); err != nil {
+		return err
+	}
+	if fl, ok := fw.w.(interface{ Flush() error }); ok && fw.flush {
+		return fl.Flush()
+	}
+	return nil
+}
+
+// Name returns the name of the file, or an empty string if it is not a file
+func (fw *fileWriter) Name() string {
+	if f, ok := fw.f.(*os.File); ok {
+		return f.Name()
+	}
+	return ""
+}
+
+// Close flushes the compressed stream and closes the file.
+// If the stream cannot be flushed, a BlobWriter is aborted instead of committed.
+func (fw *fileWriter) Close() error {
+	err := fw.w.Close()
+	if bw, ok := fw.f.(BlobWriter); ok && err != nil {
+		bw.Abort()
+		return err
+	}
+	if cerr := fw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newCompressedFileTail tails the compressed file.
+// The decompressor reads the file through followReader, which waits for the file to grow instead of returning EOF.
+func newCompressedFileTail(path string, split bufio.SplitFunc, c Compression) (*tail, error) {
+	if c == NoCompression {
+		return newFileTail(path, split)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := newTail(nil, split)
+	t.r = &decompressReader{
+		src: &followReader{r: f, t: t},
+		f:   f,
+		c:   c,
+	}
+	go t.Run()
+	return t, nil
+}
+
+// followReader reads a growing file until the tail is stopped
+type followReader struct {
+	r       io.Reader
+	t       *tail
+	stopped bool
+}
+
+func (fr *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := fr.r.Read(p)
+		if n > 0 || err != io.EOF || fr.stopped {
+			return n, err
+		}
+		select {
+		case <-fr.t.done:
+			// read the rest which was written before Stop
+			fr.stopped = true
+		case <-time.After(TailPollInterval):
+		case <-fr.t.canceled:
+			return 0, errTailCanceled
+		}
+	}
+}
+
+// decompressReader creates the decompressor on the first read,
+// because the decompressor reads the header of the stream which may not be written yet.
+type decompressReader struct {
+	src io.Reader
+	f   io.Closer
+	c   Compression
+	r   io.ReadCloser
+}
+
+func (dr *decompressReader) Read(p []byte) (int, error) {
+	if dr.r == nil {
+		r, err := dr.c.NewReader(dr.src)
+		if err != nil {
+			return 0, err
+		}
+		dr.r = r
+	}
+	return dr.r.Read(p)
+}
+
+func (dr *decompressReader) Close() error {
+	if dr.r != nil {
+		dr.r.Close()
+	}
+	return dr.f.Close()
+}
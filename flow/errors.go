@@ -0,0 +1,74 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTimeout is wrapped by the error of a task which did not finish within the timeout
+var ErrTimeout = errors.New("task timed out")
+
+// ErrFlowAborted is the cause of the cancellation of the tasks when a task fails under the FailFast policy
+var ErrFlowAborted = errors.New("flow is aborted")
+
+// ErrUpstreamFailed is wrapped by the error of a task which was aborted because a task on which it depends failed
+var ErrUpstreamFailed = errors.New("upstream task failed")
+
+// TaskError holds the errors which occurred while a task was running
+type TaskError struct {
+	Name   string
+	Errors []error
+}
+
+func (e *TaskError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("task '%v': %v", e.Name, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the original errors so that errors.Is and errors.As can inspect them
+func (e *TaskError) Unwrap() []error {
+	return e.Errors
+}
+
+// FlowError is returned by Flow.Run when one or more tasks failed
+type FlowError struct {
+	Errors []*TaskError
+}
+
+func (e *FlowError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%v task(s) failed: %v", len(e.Errors), strings.Join(msgs, ", "))
+}
+
+// Unwrap returns the error of each failed task
+func (e *FlowError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// PanicError wraps a value which was recovered from a panic in a task
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package flow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,6 +14,68 @@ import (
 type Flow struct {
 	entry   Task
 	buffers []Input
+	opts    []FlowOptions
+}
+
+type flowOptions struct {
+	ForceTasks        []string
+	ForceDownstreamOf []string
+	FailurePolicy     FailurePolicy
+	MaxConcurrency    int
+	ResourcePools     map[string]int
+}
+
+// FlowOptions configures how a flow runs
+type FlowOptions func(*flowOptions)
+
+// FailurePolicy decides what happens to the other tasks when a task fails
+type FailurePolicy int
+
+const (
+	// ContinueOnError aborts only the tasks downstream of the failed task, and lets the others finish
+	ContinueOnError FailurePolicy = iota
+	// FailFast cancels the whole flow as soon as a task fails
+	FailFast
+)
+
+// WithMaxConcurrency limits the number of tasks which run at the same time.
+// Tasks connected by streaming outputs such as ChannelOutput must run at the same time,
+// so they start together when all of them are ready, and the flow fails to run if they outnumber the limit,
+// or if one of them waits for an output of another one which is not streamed, such as FileOutput.
+func WithMaxConcurrency(n int) FlowOptions {
+	return func(opts *flowOptions) {
+		opts.MaxConcurrency = n
+	}
+}
+
+// WithResourcePool defines a named resource pool which tasks can declare by WithResource.
+// A task is queued until the pool has enough capacity for its weight.
+// Tasks connected by streaming outputs are queued together for the total weight of them, like WithMaxConcurrency.
+func WithResourcePool(name string, capacity int) FlowOptions {
+	return func(opts *flowOptions) {
+		if opts.ResourcePools == nil {
+			opts.ResourcePools = map[string]int{}
+		}
+		opts.ResourcePools[name] = capacity
+	}
+}
+
+// WithFailurePolicy sets the failure policy of the flow. The default is ContinueOnError.
+func WithFailurePolicy(policy FailurePolicy) FlowOptions {
+	return func(opts *flowOptions) {
+		opts.FailurePolicy = policy
+	}
+}
+
+func (fl *Flow) options(opts []FlowOptions) *flowOptions {
+	op := new(flowOptions)
+	for _, opt := range fl.opts {
+		opt(op)
+	}
+	for _, opt := range opts {
+		opt(op)
+	}
+	return op
 }
 
 type Stats struct {
@@ -48,52 +111,203 @@ func (fl *Flow) StatsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (fl *Flow) Run() (*Result, error) {
+// Run validates the flow, starts all tasks and waits for them to finish.
+// If any task fails, the returned error is a *FlowError which holds the errors of each failed task.
+// The options are applied after the options passed to New.
+func (fl *Flow) Run(opts ...FlowOptions) (*Result, error) {
+	return fl.RunContext(context.Background(), opts...)
+}
+
+// RunContext is like Run but cancels the flow when ctx is done.
+// On cancellation, blocked outputs and the readers of them are released,
+// and the tasks which have not started yet fail with ctx.Err().
+func (fl *Flow) RunContext(ctx context.Context, opts ...FlowOptions) (*Result, error) {
+	if err := fl.Validate(); err != nil {
+		return nil, err
+	}
+	op := fl.options(opts)
+	forced, err := fl.forcedTasks(op)
+	if err != nil {
+		return nil, err
+	}
+	tasks := sortTasks(fl.entry.(*task))
+	// check the resources before forcing, so that the flow has no side effects until all options are valid
+	pools := newResourcePools(op)
+	for _, tk := range tasks {
+		if err := checkResources(pools, tk); err != nil {
+			return nil, err
+		}
+	}
+	runCtx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+
+	isForced := map[*task]bool{}
+	for _, tk := range forced {
+		isForced[tk] = true
+	}
+	groups, err := resourceGroups(runCtx, pools, tasks, isForced)
+	if err != nil {
+		return nil, err
+	}
+	for _, tk := range forced {
+		if err := tk.force(); err != nil {
+			return nil, err
+		}
+	}
 	rs := newResult()
+	rs.policy = op.FailurePolicy
+	rs.abort = abort
+	rs.resources = groups
+	for _, tk := range tasks {
+		tk.setContext(context.WithCancelCause(runCtx))
+		rs.addTask(tk)
+	}
 	fl.run(rs, nil, []Input{&taskInput{tk: fl.entry.(*task)}})
-	rs.wg.Wait()
-	return rs, nil
+	finished := make(chan struct{})
+	go func() {
+		rs.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-runCtx.Done():
+		cause := context.Cause(runCtx)
+		Logger.Printf("Flow is canceled: %v\n", cause)
+		rs.cancel(cause)
+		<-finished
+	}
+	if err := rs.err(); err != nil {
+		return rs, err
+	}
+	return rs, ctx.Err()
 }
 
-func New(tk Task) *Flow {
-	return &Flow{entry: tk}
+func New(tk Task, opts ...FlowOptions) *Flow {
+	return &Flow{entry: tk, opts: opts}
 }
 
 // Run resolves the dependency of the specified task and starts it
-func Run(tk Task) (*Result, error) {
-	return New(tk).Run()
+func Run(tk Task, opts ...FlowOptions) (*Result, error) {
+	return New(tk, opts...).Run()
 }
 
 type Result struct {
-	wg    *sync.WaitGroup
-	mu    sync.Mutex
-	graph *gographviz.Graph
+	wg        *sync.WaitGroup
+	mu        sync.Mutex
+	graph     *gographviz.Graph
+	errs      []*TaskError
+	tasks     []*task
+	reports   map[*task]*TaskReport
+	children  map[*task][]*task
+	resources map[*task]*resourceGroup
+
+	policy FailurePolicy
+	abort  context.CancelCauseFunc
 }
 
 func newResult() *Result {
 	return &Result{
-		wg:    new(sync.WaitGroup),
-		graph: newGraph(fmt.Sprintf(`digraph %v {}`, GraphName)),
+		wg:       new(sync.WaitGroup),
+		graph:    newGraph(fmt.Sprintf(`digraph %v {}`, GraphName)),
+		reports:  map[*task]*TaskReport{},
+		children: map[*task][]*task{},
 	}
 }
 
 // Graph returns graph string
 func (rs *Result) Graph() string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
 	return rs.graph.String()
 }
 
+func (rs *Result) addNode(name, label string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.graph.AddNode(
+		GraphName,
+		escapeString(name),
+		map[string]string{
+			"label": fmt.Sprintf("%#v", label),
+		})
+}
+
+func (rs *Result) addError(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if te, ok := err.(*TaskError); ok {
+		rs.errs = append(rs.errs, te)
+	}
+}
+
+func (rs *Result) addTask(tk *task) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.tasks = append(rs.tasks, tk)
+	rs.reports[tk] = newTaskReport(tk)
+	for _, in := range tk.inputs {
+		for _, parent := range in.(TaskInput).Tasks() {
+			rs.children[parent] = append(rs.children[parent], tk)
+		}
+	}
+}
+
+// fail aborts other tasks according to the failure policy
+func (rs *Result) fail(tk *task, err error) {
+	switch rs.policy {
+	case FailFast:
+		rs.abort(fmt.Errorf("%w: task '%v' failed", ErrFlowAborted, tk.Name()))
+	default:
+		rs.abortDownstream(tk, fmt.Errorf("upstream task '%v' failed: %w", tk.Name(), ErrUpstreamFailed))
+	}
+}
+
+func (rs *Result) abortDownstream(tk *task, cause error) {
+	for _, child := range rs.children[tk] {
+		child.abort(cause)
+		rs.abortDownstream(child, cause)
+	}
+}
+
+// cancel releases the inputs and outputs of all tasks
+func (rs *Result) cancel(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, tk := range rs.tasks {
+		tk.cancel(err)
+	}
+}
+
+func (rs *Result) addEdge(parent, child, label string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.graph.AddEdge(
+		escapeString(parent),
+		escapeString(child),
+		true,
+		map[string]string{
+			"label": escapeString(label),
+		})
+}
+
+// err returns a FlowError if any task failed
+func (rs *Result) err() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.errs) == 0 {
+		return nil
+	}
+	errs := make([]*TaskError, len(rs.errs))
+	copy(errs, rs.errs)
+	return &FlowError{Errors: errs}
+}
+
 func (fl *Flow) run(rs *Result, child Task, ins []Input) {
 	for _, in := range ins {
 		fl.buffers = append(fl.buffers, resolveDependentInputs(in)...)
 		for _, tk := range in.(TaskInput).Tasks() {
 			if child != nil {
-				rs.graph.AddEdge(
-					escapeString(tk.Name()),
-					escapeString(child.Name()),
-					true,
-					map[string]string{
-						"label": escapeString(in.(TaskInput).String()),
-					})
+				rs.addEdge(tk.Name(), child.Name(), in.(TaskInput).String())
 			}
 			if tk.isDone() {
 				continue
@@ -102,37 +316,62 @@ func (fl *Flow) run(rs *Result, child Task, ins []Input) {
 			if tk.isSkip() {
 				Logger.Printf("Task '%v' is already done, skip this\n", tk.Name())
 				tk.skip()
-				rs.graph.AddNode(
-					GraphName,
-					escapeString(tk.Name()),
-					map[string]string{
-						"label": fmt.Sprintf("%#v", fmt.Sprintf("%v\n(skipped)", tk.Name())),
-					})
+				rs.setFinished(tk, TaskSkipped)
+				rs.addNode(tk.Name(), fmt.Sprintf("%v\n(skipped)", tk.Name()))
 				continue
 			}
 
 			rs.wg.Add(1)
-			go func(tk Task) {
+			go func(tk *task) {
 				defer rs.wg.Done()
-				defer func(tk Task) {
-					if err := recover(); err != nil {
-						Logger.Printf("Task '%v' got an error %v\n", tk.Name(), err)
+				started := false
+				defer func(tk *task) {
+					if v := recover(); v != nil {
+						Logger.Printf("Task '%v' got an error %v\n", tk.Name(), v)
+						tk.addError(&PanicError{Value: v})
+					}
+					err := tk.err()
+					if err == nil {
+						rs.setFinished(tk, TaskSucceeded)
+						return
+					}
+					rs.addError(err)
+					rs.setFinished(tk, tk.failedState(started))
+					if started {
 						tk.destroy()
 					}
+					tk.cancel(err)
+					rs.fail(tk, err)
 				}(tk)
 				Logger.Printf("Task '%v' is ready?\n", tk.Name())
-				<-tk.ready()
+				g := rs.resources[tk]
+				if err := tk.wait(); err != nil {
+					Logger.Printf("Task '%v' is not started: %v\n", tk.Name(), err)
+					tk.addError(err)
+					if g != nil {
+						g.leave()
+					}
+					return
+				}
+				if g != nil {
+					Logger.Printf("Task '%v' is waiting for resources\n", tk.Name())
+					defer g.release()
+					if err := g.wait(tk.parentContext()); err != nil {
+						Logger.Printf("Task '%v' is not started: %v\n", tk.Name(), err)
+						tk.addError(err)
+						return
+					}
+				}
+				started = true
 				Logger.Printf("Task '%v' is started\n", tk.Name())
-				started := time.Now()
-				tk.run()
-				et := time.Since(started).String()
+				rs.setStarted(tk)
+				begin := time.Now()
+				if err := tk.run(); err != nil {
+					Logger.Printf("Task '%v' failed: %v\n", tk.Name(), err)
+				}
+				et := time.Since(begin).String()
 				Logger.Printf("Task '%v' is finished. Elapsed time is %v\n", tk.Name(), et)
-				rs.graph.AddNode(
-					GraphName,
-					escapeString(tk.Name()),
-					map[string]string{
-						"label": fmt.Sprintf("%#v", fmt.Sprintf("%v\ntime:%v", tk.Name(), et)),
-					})
+				rs.addNode(tk.Name(), fmt.Sprintf("%v\ntime:%v", tk.Name(), et))
 			}(tk)
 			fl.run(rs, tk, tk.inputs)
 		}
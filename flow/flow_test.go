@@ -0,0 +1,1035 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	Logger = log.New(ioutil.Discard, "", log.LstdFlags)
+}
+
+func TestRunError(t *testing.T) {
+	errFailed := errors.New("failed")
+	in := NewTask(
+		"input",
+		WithOutputs(NewChannelOutput("channel", make(chan interface{}, 1))),
+		WithProcessor(func(tk Task) error {
+			tk.Out().Write(1)
+			return errFailed
+		}),
+	)
+	out := NewTask(
+		"output",
+		WithInputs(in.Out()),
+		WithProcessor(func(tk Task) error {
+			for range tk.In().Channel() {
+			}
+			panic("output panic")
+		}),
+	)
+	_, err := Run(out)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !errors.Is(err, errFailed) {
+		t.Errorf("%v does not wrap %v", err, errFailed)
+	}
+	var perr *PanicError
+	if !errors.As(err, &perr) {
+		t.Errorf("%v does not contain a panic error", err)
+	}
+	var ferr *FlowError
+	if !errors.As(err, &ferr) || len(ferr.Errors) != 2 {
+		t.Errorf("unexpected error: %#v", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	in := NewTask(
+		"input",
+		WithOutputs(NewChannelOutput("channel", make(chan interface{}))),
+		WithProcessor(func(tk Task) error {
+			for {
+				if err := tk.Out().Write(1); err != nil {
+					return err
+				}
+			}
+		}),
+	)
+	out := NewTask(
+		"output",
+		WithInputs(in.Out()),
+		WithProcessorContext(func(ctx context.Context, tk Task) error {
+			<-ctx.Done()
+			for range tk.In().Channel() {
+			}
+			return nil
+		}),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := New(out).RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	out, err := NewFileOutput(filepath.Join(t.TempDir(), "retry.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts int32
+	in := NewTask(
+		"input",
+		WithOutputs(out),
+		WithProcessor(func(tk Task) error {
+			tk.Out().Write("a\n")
+			tk.Out().Write("b\n")
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return errors.New("transient error")
+			}
+			return nil
+		}),
+		WithRetry(3, ConstantBackoff(10*time.Millisecond)),
+	)
+	var lines []string
+	last := NewTask(
+		"output",
+		WithInputs(in.Out()),
+		WithProcessor(func(tk Task) error {
+			for it := range tk.In().Channel() {
+				lines = append(lines, String(it))
+			}
+			return nil
+		}),
+	)
+	rs, err := Run(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts: %v != 2", attempts)
+	}
+	if len(lines) != 2 || lines[0] != "a" || lines[1] != "b" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	if report := rs.Task("input"); report.Attempts != 2 || report.Outputs[0].Count != 2 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+
+	// a FileStreaming output is read while it is written, so its task is not retried
+	fs, err := NewFileStreaming(filepath.Join(t.TempDir(), "stream.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewTask(
+		"stream",
+		WithOutputs(fs),
+		WithProcessor(func(tk Task) error {
+			tk.Out().Write("a")
+			return errors.New("transient error")
+		}),
+		WithRetry(3, ConstantBackoff(10*time.Millisecond)),
+	)
+	rs, err = Run(stream)
+	if err == nil {
+		t.Fatal("the error is not returned")
+	}
+	if report := rs.Task("stream"); report.Attempts != 1 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+}
+
+func TestTaskReport(t *testing.T) {
+	dir := t.TempDir()
+	newOutput := func(name string) Output {
+		out, err := NewFileOutput(filepath.Join(dir, name), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "skipped.txt"), []byte("done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	skipped := NewTask("skipped", WithOutputs(newOutput("skipped.txt")), WithProcessor(func(tk Task) error {
+		return nil
+	}))
+	good := NewTask("good", WithOutputs(newOutput("good.txt")), WithWorker(2), WithProcessor(func(tk Task) error {
+		return tk.Out().Write("ok")
+	}))
+	bad := NewTask("bad", WithOutputs(newOutput("bad.txt")), WithProcessor(func(tk Task) error {
+		return errors.New("failed")
+	}))
+	child := NewTask("child", WithInputs(bad.Out()), WithOutputs(newOutput("child.txt")), WithProcessor(func(tk Task) error {
+		return nil
+	}))
+	entry := NewTask("entry", WithInputs(skipped.Out(), good.Out(), child.Out()), WithProcessor(func(tk Task) error {
+		return nil
+	}))
+	rs, err := Run(entry)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := map[string]TaskState{
+		"skipped": TaskSkipped,
+		"good":    TaskSucceeded,
+		"bad":     TaskFailed,
+		"child":   TaskUpstreamFailed,
+		"entry":   TaskUpstreamFailed,
+	}
+	if len(rs.Tasks()) != len(expected) {
+		t.Fatalf("unexpected reports: %v", rs.Tasks())
+	}
+	for _, r := range rs.Tasks() {
+		if r.State != expected[r.Name] {
+			t.Errorf("task '%v' is %v, expected %v", r.Name, r.State, expected[r.Name])
+		}
+	}
+	if r := rs.Task("good"); r.Workers != 2 || r.Attempts != 1 || r.Outputs[0].Count != 2 || r.Elapsed <= 0 || r.Error != nil {
+		t.Errorf("unexpected report: %#v", r)
+	}
+	if r := rs.Task("bad"); r.Error == nil || r.Attempts != 1 {
+		t.Errorf("unexpected report: %#v", r)
+	}
+	if r := rs.Task("child"); !errors.Is(r.Error, ErrUpstreamFailed) || r.Attempts != 0 || !r.StartTime.IsZero() {
+		t.Errorf("unexpected report: %#v", r)
+	}
+	if names := rs.UpstreamFailed(); strings.Join(names, ",") != "child,entry" {
+		t.Errorf("unexpected upstream failed tasks: %v", names)
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Tasks []struct {
+			Name    string
+			State   string
+			Elapsed string
+			Error   string
+		}
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range decoded.Tasks {
+		failed := r.State == "failed" || r.State == "upstream_failed"
+		if r.State != expected[r.Name].String() || r.Elapsed == "" || failed != (r.Error != "") {
+			t.Errorf("unexpected json: %s", b)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := NewTask("slow", WithProcessorContext(func(ctx context.Context, tk Task) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	rs, err = New(slow).RunContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st := rs.Task("slow").State; st != TaskCanceled {
+		t.Errorf("task 'slow' is %v, expected %v", st, TaskCanceled)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timeout.txt")
+	out, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hung := make(chan struct{})
+	defer close(hung)
+	tk := NewTask(
+		"hung",
+		WithOutputs(out),
+		WithProcessor(func(tk Task) error {
+			tk.Out().Write("partial\n")
+			<-hung
+			return nil
+		}),
+		WithTimeout(50*time.Millisecond),
+	)
+	_, err = Run(tk)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if IsFileExists(path) {
+		t.Errorf("%v is not destroyed", path)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	in := NewTask(
+		"input",
+		WithOutputs(NewChannelOutput("channel", make(chan interface{}))),
+		WithProcessor(func(tk Task) error { return nil }),
+	)
+	a := NewTask(
+		"task",
+		WithInputs(in.Out()),
+		WithOutputs(NewChannelOutput("a", make(chan interface{}))),
+	)
+	b := NewTask(
+		"task",
+		WithInputs(in.Out()),
+		WithOutputs(NewChannelOutput("b", make(chan interface{}))),
+		WithProcessor(func(tk Task) error { return nil }),
+	)
+	_, err := Run(NewTask(
+		"output",
+		WithInputs(a.Out(), b.Out()),
+		WithProcessor(func(tk Task) error { return nil }),
+	))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	var (
+		derr *DuplicateTaskError
+		perr *NoProcessorError
+		serr *SharedOutputError
+	)
+	if !errors.As(err, &derr) || derr.Name != "task" {
+		t.Errorf("duplicate task name is not detected: %v", err)
+	}
+	if !errors.As(err, &perr) || perr.Task != "task" {
+		t.Errorf("task without processor is not detected: %v", err)
+	}
+	if !errors.As(err, &serr) || len(serr.Tasks) != 2 {
+		t.Errorf("shared output is not detected: %v", err)
+	}
+
+	newChannel := func(name string) Output {
+		return NewChannelOutput(name, make(chan interface{}))
+	}
+	nop := WithProcessor(func(tk Task) error { return nil })
+	// x and y depend on each other, and the entry depends on x
+	x := NewTask("x", WithOutputs(newChannel("x1"), newChannel("x2")), nop)
+	y := NewTask("y", WithInputs(x.Out(0)), WithOutputs(newChannel("y")), nop)
+	x.(*task).inputs = append(x.(*task).inputs, y.Out())
+	err = New(NewTask("entry", WithInputs(x.Out(1)), nop)).Validate()
+	var cerr *CycleError
+	if !errors.As(err, &cerr) || strings.Join(cerr.Tasks, ",") != "x,y,x" {
+		t.Errorf("unexpected cycle: %v", err)
+	}
+
+	// a diamond whose top has an upstream task, and a task which reads the same output twice
+	root := NewTask("root", WithOutputs(newChannel("root")), nop)
+	top := NewTask("top", WithInputs(root.Out()), WithOutputs(newChannel("left"), newChannel("right")), nop)
+	left := NewTask("left", WithInputs(top.Out(0)), WithOutputs(newChannel("l")), nop)
+	right := NewTask("right", WithInputs(top.Out(1)), WithOutputs(newChannel("r")), nop)
+	bottom := NewTask("bottom", WithInputs(left.Out(), right.Out(), right.Out()), nop)
+	if err := New(bottom).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if g := GetGraphString(bottom); strings.Count(g, "->") != 5 {
+		t.Errorf("unexpected graph: %v", g)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.txt")
+	if err := ioutil.WriteFile(path, []byte("done\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := NewTask("input", WithOutputs(out), WithProcessor(func(tk Task) error { return nil }))
+	last := NewTask("output", WithInputs(in.Out()), WithProcessor(func(tk Task) error { return nil }))
+	pl, err := New(last).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pl.Tasks) != 2 {
+		t.Fatalf("unexpected plan: %v", pl)
+	}
+	if pt := pl.Tasks[0]; !pt.Skip || pt.Outputs[0].Location != path || !pt.Outputs[0].Exists {
+		t.Errorf("unexpected planned task: %#v", pt)
+	}
+	if pt := pl.Tasks[1]; pt.Skip {
+		t.Errorf("unexpected planned task: %#v", pt)
+	}
+}
+
+func TestForceTasks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "force.txt")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := NewTask("input", WithOutputs(out), WithProcessor(func(tk Task) error {
+		return tk.Out().Write("new\n")
+	}))
+	var lines []string
+	last := NewTask("output", WithInputs(in.Out()), WithProcessor(func(tk Task) error {
+		for it := range tk.In().Channel() {
+			lines = append(lines, String(it))
+		}
+		return nil
+	}))
+	fl := New(last)
+	pl, err := fl.Plan(ForceTasks("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pl.Tasks[0].Skip {
+		t.Errorf("forced task is skipped: %v", pl)
+	}
+	if _, err := fl.Run(ForceTasks("input")); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != "new" {
+		t.Errorf("unexpected lines: %v", lines)
+	}
+	if _, err := fl.Plan(ForceDownstreamOf("unknown")); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	newFlow := func(t *testing.T) *Flow {
+		dir := t.TempDir()
+		newOutput := func(name string) Output {
+			out, err := NewFileOutput(filepath.Join(dir, name), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return out
+		}
+		bad := NewTask("bad", WithOutputs(newOutput("bad.txt")), WithProcessor(func(tk Task) error {
+			return errors.New("failed")
+		}))
+		child := NewTask("child", WithInputs(bad.Out()), WithOutputs(newOutput("child.txt")), WithProcessor(func(tk Task) error {
+			return nil
+		}))
+		good := NewTask("good", WithOutputs(newOutput("good.txt")), WithProcessorContext(func(ctx context.Context, tk Task) error {
+			select {
+			case <-time.After(100 * time.Millisecond):
+				return tk.Out().Write("ok\n")
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}))
+		return New(NewTask("entry", WithInputs(child.Out(), good.Out()), WithProcessor(func(tk Task) error {
+			return nil
+		})))
+	}
+
+	rs, err := newFlow(t).Run()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for name, state := range map[string]TaskState{
+		"bad":   TaskFailed,
+		"child": TaskUpstreamFailed,
+		"good":  TaskSucceeded,
+		"entry": TaskUpstreamFailed,
+	} {
+		if st := rs.Task(name).State; st != state {
+			t.Errorf("ContinueOnError: task '%v' is %v, expected %v", name, st, state)
+		}
+	}
+
+	rs, err = newFlow(t).Run(WithFailurePolicy(FailFast))
+	if !errors.Is(err, ErrFlowAborted) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st := rs.Task("good").State; st != TaskCanceled {
+		t.Errorf("FailFast: task 'good' is %v", st)
+	}
+}
+
+func TestResourcePool(t *testing.T) {
+	dir := t.TempDir()
+	var running, maxRunning int32
+	var inputs []Input
+	for i := 0; i < 4; i++ {
+		out, err := NewFileOutput(filepath.Join(dir, fmt.Sprintf("%v.txt", i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tk := NewTask(fmt.Sprintf("task%v", i), WithOutputs(out), WithResource("s3", 1), WithProcessor(func(tk Task) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(30 * time.Millisecond)
+			return nil
+		}))
+		inputs = append(inputs, tk.Out())
+	}
+	entry := NewTask("entry", WithInputs(inputs...), WithProcessor(func(tk Task) error { return nil }))
+	if _, err := Run(entry, WithResourcePool("s3", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning != 2 {
+		t.Errorf("max running tasks: %v != 2", maxRunning)
+	}
+	if _, err := Run(NewTask("unknown", WithResource("db", 1), WithProcessor(func(tk Task) error { return nil }))); err == nil {
+		t.Error("expected an error for an unknown resource pool")
+	}
+
+	// the forced output is not destroyed if the resources are invalid
+	path := filepath.Join(dir, "forced.txt")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced := NewTask("forced", WithOutputs(out), WithResource("db", 1), WithProcessor(func(tk Task) error { return nil }))
+	if _, err := Run(forced, ForceTasks("forced")); err == nil {
+		t.Error("expected an error for an unknown resource pool")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "old\n" {
+		t.Errorf("forced output is destroyed: %q, %v", b, err)
+	}
+
+	// tasks connected by a ChannelOutput run at the same time regardless of the limit
+	pipeline := func(name string) Task {
+		producer := NewTask(name+"-producer", WithOutputs(NewChannelOutput(name, make(chan interface{}))), WithProcessor(func(tk Task) error {
+			for i := 0; i < 3; i++ {
+				if err := tk.Out().Write(fmt.Sprint(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		out, err := NewFileOutput(filepath.Join(dir, name+".txt"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewTask(name+"-consumer", WithInputs(producer.Out()), WithOutputs(out), WithProcessor(func(tk Task) error {
+			for v := range tk.In().Channel() {
+				if err := tk.Out().Write(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	if _, err := Run(pipeline("single"), WithMaxConcurrency(1)); err == nil || !strings.Contains(err.Error(), "max concurrency") {
+		t.Errorf("expected an error for the max concurrency: %v", err)
+	}
+	entry = NewTask("entry", WithInputs(pipeline("a").Out(), pipeline("b").Out()), WithProcessor(func(tk Task) error { return nil }))
+	done := make(chan error)
+	go func() {
+		_, err := Run(entry, WithMaxConcurrency(2))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pipelines are deadlocked")
+	}
+
+	// the forced output is not destroyed if its group exceeds the max concurrency
+	path = filepath.Join(dir, "forced-single.txt")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Run(pipeline("forced-single"), ForceTasks("forced-single-consumer"), WithMaxConcurrency(1)); err == nil || !strings.Contains(err.Error(), "max concurrency") {
+		t.Errorf("expected an error for the max concurrency: %v", err)
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "old\n" {
+		t.Errorf("forced output is destroyed: %q, %v", b, err)
+	}
+
+	// 'd' waits for the file of 'a', while 'b' streams the values of both,
+	// so they cannot run at the same time under a limit
+	diamond := func(name string) Task {
+		file, err := NewFileOutput(filepath.Join(dir, name+".txt"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := NewTask("a", WithOutputs(file, NewChannelOutput("a", make(chan interface{}))), WithProcessor(func(tk Task) error {
+			if err := tk.Out(0).Write("0"); err != nil {
+				return err
+			}
+			return tk.Out(1).Write("1")
+		}))
+		d := NewTask("d", WithInputs(a.Out(0)), WithOutputs(NewChannelOutput("d", make(chan interface{}))), WithProcessor(func(tk Task) error {
+			for v := range tk.In().Channel() {
+				if err := tk.Out().Write(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		return NewTask("b", WithInputs(a.Out(1), d.Out()), WithProcessor(func(tk Task) error {
+			for i := 0; i < 2; i++ {
+				for range tk.In(i).Channel() {
+				}
+			}
+			return nil
+		}))
+	}
+	for i, opts := range [][]FlowOptions{nil, {WithMaxConcurrency(10)}} {
+		go func() {
+			_, err := Run(diamond(fmt.Sprintf("diamond%v", i)), opts...)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if opts == nil && err != nil {
+				t.Error(err)
+			}
+			if opts != nil && (err == nil || !strings.Contains(err.Error(), "task 'd' waits for")) {
+				t.Errorf("expected an error for the diamond: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the diamond is deadlocked")
+		}
+	}
+}
+
+func TestTypedOutput(t *testing.T) {
+	nums := NewTypedChannelOutput[int]("numbers", 1)
+	in := NewTask("input", WithOutputs(nums), WithProcessor(func(tk Task) error {
+		w := nums.Writer(tk)
+		for i := 0; i < 3; i++ {
+			if err := w.Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	var sum int
+	out := NewTask("output", WithInputs(in.Out()), WithProcessor(func(tk Task) error {
+		r := nums.Reader(tk)
+		for v := range r.Channel() {
+			sum += v
+		}
+		return r.Err()
+	}))
+	if _, err := Run(out); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Errorf("%v != 3", sum)
+	}
+	if err := nums.Write("string"); !errors.Is(err, ErrUnexpectedType) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBroadcastOutput(t *testing.T) {
+	nums := NewBroadcastOutput("numbers", 3, 2)
+	NewTask("input", WithOutputs(nums), WithProcessor(func(tk Task) error {
+		for i := 1; i <= 100; i++ {
+			if err := tk.Out().Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	errFailed := errors.New("failed")
+	sums := make([]int, 2)
+	var consumers []Input
+	for i := range sums {
+		i := i
+		name := fmt.Sprintf("sum%v", i)
+		tk := NewTask(name, WithInputs(nums.In(i)), WithOutputs(NewChannelOutput(name, make(chan interface{}))), WithProcessor(func(tk Task) error {
+			for v := range tk.In().Channel() {
+				if i == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				sums[i] += v.(int)
+			}
+			return nil
+		}))
+		consumers = append(consumers, tk.Out())
+	}
+	// the failed consumer must not block the others
+	failed := NewTask("failed", WithInputs(nums.In(2)), WithOutputs(NewChannelOutput("failed", make(chan interface{}))), WithProcessor(func(tk Task) error {
+		return errFailed
+	}))
+	out := NewTask("output", WithInputs(append(consumers, failed.Out())...), WithProcessor(func(tk Task) error {
+		return nil
+	}))
+	_, err := Run(out)
+	if !errors.Is(err, errFailed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for i, sum := range sums {
+		if sum != 5050 {
+			t.Errorf("sum%v: %v != 5050", i, sum)
+		}
+	}
+
+	// a consumer which no task reads would block the writer forever
+	tee := Tee("tee", 2)
+	NewTask("input", WithOutputs(tee), WithProcessor(func(tk Task) error {
+		return tk.Out().Write(1)
+	}))
+	first := NewTask("first", WithInputs(tee.In(0)), WithProcessor(func(tk Task) error {
+		for range tk.In().Channel() {
+		}
+		return nil
+	}))
+	var cerr *ConsumerError
+	if _, err := Run(first); !errors.As(err, &cerr) || fmt.Sprint(cerr.Consumers) != "[1]" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPartitionedOutput(t *testing.T) {
+	key := func(v interface{}) string {
+		return fmt.Sprint(v.(int) % 10)
+	}
+	parts := NewPartitionedOutput("numbers", 4, 2, key)
+	NewTask("input", WithOutputs(parts), WithProcessor(func(tk Task) error {
+		for i := 1; i <= 100; i++ {
+			if err := tk.Out().Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	var inputs []Input
+	for i := 0; i < 4; i++ {
+		inputs = append(inputs, parts.In(i))
+	}
+	var sum int64
+	owners := make([]int32, 10) // partition+1 which received each key
+	out := NewTask("sum", WithWorker(4), WithInputs(inputs...), WithProcessorContext(func(ctx context.Context, tk Task) error {
+		idx := WorkerIndex(ctx)
+		for v := range tk.In(idx).Channel() {
+			n := v.(int)
+			if !atomic.CompareAndSwapInt32(&owners[n%10], 0, int32(idx+1)) && atomic.LoadInt32(&owners[n%10]) != int32(idx+1) {
+				return fmt.Errorf("key %v is read by multiple partitions", n%10)
+			}
+			if p := parts.Partition(n); p != idx {
+				return fmt.Errorf("%v is routed to %v, not %v", n, idx, p)
+			}
+			atomic.AddInt64(&sum, int64(n))
+		}
+		return nil
+	}))
+	if _, err := Run(out); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 5050 {
+		t.Errorf("%v != 5050", sum)
+	}
+
+	for _, f := range []func(){
+		func() { NewPartitionedOutput("empty", 0, 0, key) },
+		func() { NewPartitionedOutput("nokey", 2, 0, nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			f()
+		}()
+	}
+
+	// all partitions must be read
+	nop := WithProcessor(func(tk Task) error { return nil })
+	parts = NewPartitionedOutput("numbers", 4, 0, key)
+	NewTask("input", WithOutputs(parts), nop)
+	var perr *PartitionError
+	err := New(NewTask("sum", WithWorker(2), WithInputs(parts.In(0), parts.In(1), parts.In(2), parts.In(3)), nop)).Validate()
+	if !errors.As(err, &perr) || perr.Task != "sum" || perr.Workers != 2 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// a combined input reads the partitions together
+	pairs := NewPartitionedOutput("pairs", 2, 0, key)
+	NewTask("input", WithOutputs(pairs), nop)
+	if err := New(NewTask("combined", WithInputs(CombineInputs(pairs.In(0), pairs.In(1))), nop)).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = New(NewTask("first", WithInputs(parts.In(0)), nop)).Validate()
+	if !errors.As(err, &perr) || fmt.Sprint(perr.Partitions) != "[1 2 3]" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a value for a canceled partition is not dropped silently
+	cancelOutput(parts.In(parts.Partition(1)).(TaskInput), errors.New("canceled"))
+	if err := parts.Write(1); !errors.Is(err, ErrCanceledPartition) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamOperators(t *testing.T) {
+	in := NewTask("input", WithOutputs(NewChannelOutput("numbers", make(chan interface{}))), WithProcessor(func(tk Task) error {
+		for i := 1; i <= 100; i++ {
+			if err := tk.Out().Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	double := Map("double", in.Out(), func(v interface{}) (interface{}, error) {
+		if v.(int)%3 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return v.(int) * 2, nil
+	}, WithWorker(4), WithOrder())
+	mul4 := Filter("mul4", double.Out(), func(v interface{}) (bool, error) {
+		return v.(int)%4 == 0, nil
+	}, WithWorker(2), WithOrder())
+	dup := FlatMap("dup", mul4.Out(), func(v interface{}) ([]interface{}, error) {
+		return []interface{}{v, v}, nil
+	})
+	batches := Batch("batch", dup.Out(), 10, time.Second)
+	var got []interface{}
+	out := NewTask("output", WithInputs(batches.Out()), WithProcessor(func(tk Task) error {
+		for b := range tk.In().Channel() {
+			if len(b.([]interface{})) != 10 {
+				return fmt.Errorf("unexpected batch: %v", b)
+			}
+			got = append(got, b.([]interface{})...)
+		}
+		return nil
+	}))
+	if _, err := Run(out); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Fatalf("%v values != 100", len(got))
+	}
+	for i, v := range got {
+		if expected := (i/2 + 1) * 4; v != expected {
+			t.Fatalf("got[%v]: %v != %v", i, v, expected)
+		}
+	}
+
+	// a processor which reads the input by itself cannot keep the order with multiple workers
+	for _, tk := range []Task{
+		Batch("batch", in.Out(), 10, time.Second, WithOrder(), WithWorker(2)),
+		NewTask("processor", WithInputs(in.Out()), WithOrder(), WithWorker(2), WithProcessor(func(tk Task) error { return nil })),
+	} {
+		var oerr *OrderError
+		if err := New(tk).Validate(); !errors.As(err, &oerr) || oerr.Workers != 2 {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if err := New(Batch("batch", in.Out(), 10, time.Second, WithOrder())).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOrderedWorker(t *testing.T) {
+	in := NewTask("input", WithOutputs(NewChannelOutput("numbers", make(chan interface{}))), WithProcessor(func(tk Task) error {
+		for i := 0; i < 100; i++ {
+			if err := tk.Out().Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	squares := NewTypedChannelOutput[int]("squares", 0)
+	var running, maxRunning int32
+	sq := NewTask("square", WithInputs(in.Out()), WithOutputs(squares), WithOrderedWorker(4, 6), WithItemProcessor(func(ctx context.Context, tk Task, v interface{}) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		i := v.(int)
+		// later values finish earlier within each group of workers
+		time.Sleep(time.Duration(4-i%4) * time.Millisecond)
+		w := squares.Writer(tk)
+		if err := w.Write(i); err != nil {
+			return err
+		}
+		return w.Write(i * i)
+	}))
+	var got []int
+	out := NewTask("output", WithInputs(sq.Out()), WithProcessor(func(tk Task) error {
+		r := squares.Reader(tk)
+		for v := range r.Channel() {
+			got = append(got, v)
+		}
+		return r.Err()
+	}))
+	if _, err := Run(out); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 200 {
+		t.Fatalf("%v values != 200", len(got))
+	}
+	for i := 0; i < 100; i++ {
+		if got[i*2] != i || got[i*2+1] != i*i {
+			t.Fatalf("unexpected order at %v: %v", i, got[i*2:i*2+2])
+		}
+	}
+	if maxRunning < 2 {
+		t.Errorf("values are not processed in parallel")
+	}
+
+	// a panic of a value stops the other workers, which wait for it in the reorder buffer
+	in = NewTask("input", WithOutputs(NewChannelOutput("numbers", make(chan interface{}))), WithProcessor(func(tk Task) error {
+		for i := 0; i < 100; i++ {
+			if err := tk.Out().Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	sq = NewTask("square", WithInputs(in.Out()), WithOutputs(NewChannelOutput("squares", make(chan interface{}))), WithOrderedWorker(4, 6),
+		WithItemProcessor(func(ctx context.Context, tk Task, v interface{}) error {
+			if v.(int) == 10 {
+				panic("boom")
+			}
+			return tk.Out().Write(v.(int) * v.(int))
+		}))
+	out = NewTask("output", WithInputs(sq.Out()), WithProcessor(func(tk Task) error {
+		for range tk.In().Channel() {
+		}
+		return nil
+	}))
+	done := make(chan error, 1)
+	go func() {
+		_, err := Run(out)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var perr *PanicError
+		if !errors.As(err, &perr) || perr.Value != "boom" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flow is not finished after a panic")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	key := func(v interface{}) string {
+		return v.(string)[:1]
+	}
+	source := func(name string, vs ...string) Task {
+		return NewTask(name, WithOutputs(NewChannelOutput(name, make(chan interface{}))), WithProcessor(func(tk Task) error {
+			for _, v := range vs {
+				if err := tk.Out().Write(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	cases := []struct {
+		mode     JoinMode
+		expected []string
+		hash     []string // the hash join writes the unmatched right values at last
+	}{
+		{InnerJoin, []string{"b1-b3", "b2-b3", "d1-d2", "d1-d3"}, nil},
+		{LeftJoin, []string{"a1-", "b1-b3", "b2-b3", "d1-d2", "d1-d3"}, nil},
+		{FullOuterJoin, []string{"a1-", "b1-b3", "b2-b3", "-c1", "d1-d2", "d1-d3"}, []string{"a1-", "b1-b3", "b2-b3", "d1-d2", "d1-d3", "-c1"}},
+	}
+	for _, sortMerge := range []bool{false, true} {
+		for _, c := range cases {
+			var opts []Options
+			if sortMerge {
+				opts = append(opts, WithSortMergeJoin())
+			}
+			left := source("left", "a1", "b1", "b2", "d1")
+			right := source("right", "b3", "c1", "d2", "d3")
+			joined := Join("join", left.Out(), right.Out(), key, key, c.mode, opts...)
+			var got []string
+			out := NewTask("output", WithInputs(joined.Out()), WithProcessor(func(tk Task) error {
+				for v := range tk.In().Channel() {
+					j := v.(Joined)
+					l, _ := j.Left.(string)
+					r, _ := j.Right.(string)
+					got = append(got, l+"-"+r)
+				}
+				return nil
+			}))
+			if _, err := Run(out); err != nil {
+				t.Fatal(err)
+			}
+			expected := c.expected
+			if !sortMerge && c.hash != nil {
+				expected = c.hash
+			}
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Errorf("sortMerge=%v mode=%v: %v != %v", sortMerge, c.mode, got, expected)
+			}
+		}
+	}
+
+	left := source("left", "b1", "a1")
+	right := source("right", "a2")
+	joined := Join("join", left.Out(), right.Out(), key, key, InnerJoin, WithSortMergeJoin())
+	out := NewTask("output", WithInputs(joined.Out()), WithProcessor(func(tk Task) error {
+		for range tk.In().Channel() {
+		}
+		return nil
+	}))
+	if _, err := Run(out); !errors.Is(err, ErrUnsortedInput) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a hash join blocks the task which streams both inputs, so it is rejected
+	selfJoin := func(opts ...Options) Task {
+		tee := Tee("values", 2)
+		NewTask("values", WithOutputs(tee), WithProcessor(func(tk Task) error {
+			for _, v := range []string{"a1", "b1", "b2"} {
+				if err := tk.Out().Write(v); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		upper := Map("upper", tee.In(0), func(v interface{}) (interface{}, error) {
+			return strings.ToUpper(v.(string)), nil
+		})
+		joined := Join("join", upper.Out(), tee.In(1), func(v interface{}) string {
+			return strings.ToLower(key(v))
+		}, key, InnerJoin, opts...)
+		var got []string
+		return NewTask("output", WithInputs(joined.Out()), WithProcessor(func(tk Task) error {
+			for v := range tk.In().Channel() {
+				j := v.(Joined)
+				got = append(got, j.Left.(string)+"-"+j.Right.(string))
+			}
+			if strings.Join(got, ",") != "A1-a1,B1-b1,B1-b2,B2-b1,B2-b2" {
+				return fmt.Errorf("unexpected values: %v", got)
+			}
+			return nil
+		}))
+	}
+	var jerr *JoinError
+	if _, err := Run(selfJoin()); !errors.As(err, &jerr) || jerr.Task != "join" || jerr.Upstream != "values" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := Run(selfJoin(WithSortMergeJoin())); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package flow
+
+import "fmt"
+
+// ForceTasks runs the specified tasks and all tasks downstream of them even if their outputs already exist.
+// The existing outputs are destroyed before the flow starts.
+func ForceTasks(names ...string) FlowOptions {
+	return func(opts *flowOptions) {
+		opts.ForceTasks = append(opts.ForceTasks, names...)
+	}
+}
+
+// ForceDownstreamOf runs all tasks downstream of the specified tasks even if their outputs already exist.
+// Unlike ForceTasks, the specified tasks themselves are not forced.
+func ForceDownstreamOf(names ...string) FlowOptions {
+	return func(opts *flowOptions) {
+		opts.ForceDownstreamOf = append(opts.ForceDownstreamOf, names...)
+	}
+}
+
+// forcedTasks returns the tasks to be forced in dependency order
+func (fl *Flow) forcedTasks(op *flowOptions) ([]*task, error) {
+	tasks := sortTasks(fl.entry.(*task))
+	byName := map[string]*task{}
+	children := map[*task][]*task{}
+	for _, tk := range tasks {
+		byName[tk.Name()] = tk
+		for _, in := range tk.inputs {
+			for _, parent := range in.(TaskInput).Tasks() {
+				children[parent] = append(children[parent], tk)
+			}
+		}
+	}
+	forced := map[*task]bool{}
+	var force func(tk *task)
+	force = func(tk *task) {
+		if forced[tk] {
+			return
+		}
+		forced[tk] = true
+		for _, child := range children[tk] {
+			force(child)
+		}
+	}
+	for _, name := range op.ForceTasks {
+		tk, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot force unknown task '%v'", name)
+		}
+		force(tk)
+	}
+	for _, name := range op.ForceDownstreamOf {
+		tk, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot force unknown task '%v'", name)
+		}
+		for _, child := range children[tk] {
+			force(child)
+		}
+	}
+	var sorted []*task
+	for _, tk := range tasks {
+		if forced[tk] {
+			sorted = append(sorted, tk)
+		}
+	}
+	return sorted, nil
+}
@@ -0,0 +1,75 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrRecordTooLarge = errors.New("ErrRecordTooLarge")
+
+	// LineFraming terminates each record by a newline
+	LineFraming Framing = lineFraming{}
+	// LengthPrefixFraming prefixes each record with its length, so records may contain any bytes
+	LengthPrefixFraming Framing = lengthPrefixFraming{}
+)
+
+// MaxRecordSize is the maximum size of a length-prefixed record, and of a record read from a blob store
+var MaxRecordSize = 1 << 30
+
+// Framing decides how serialized records are delimited in a file or an object
+type Framing interface {
+	// Frame returns the record with its delimiter or prefix
+	Frame(record []byte) []byte
+	// Split is a bufio.SplitFunc which returns each record without its delimiter or prefix
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+}
+
+type lineFraming struct{}
+
+func (lineFraming) Frame(record []byte) []byte {
+	return append(record, '\n')
+}
+
+func (lineFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return bufio.ScanLines(data, atEOF)
+}
+
+// rawFraming writes each record as it is, and splits the records by newlines.
+// It is the framing of FileOutput with the default serializer, whose writers terminate each record by themselves.
+type rawFraming struct{}
+
+func (rawFraming) Frame(record []byte) []byte {
+	return record
+}
+
+func (rawFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return bufio.ScanLines(data, atEOF)
+}
+
+type lengthPrefixFraming struct{}
+
+func (lengthPrefixFraming) Frame(record []byte) []byte {
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(record)), uint64(len(record)))
+	return append(b, record...)
+}
+
+func (lengthPrefixFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	size, n := binary.Uvarint(data)
+	switch {
+	case n < 0 || size > uint64(MaxRecordSize):
+		return 0, nil, ErrRecordTooLarge
+	case n == 0 || uint64(len(data)-n) < size:
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	end := n + int(size)
+	return end, data[n:end:end], nil
+}
@@ -104,17 +104,43 @@ func (ec *edgeCache) Get(cnode, pnode *graphNode, out Output) (*graphEdge, bool)
 	return edge, true
 }
 
+// walk adds the tasks on which tk depends and the edges between them to the graph.
+// Each task is walked once, so a task can be shared by multiple downstream tasks such as a diamond.
 func walk(ec *edgeCache, nc *nodeCache, tk *task) {
 	node, _ := nc.Get(tk)
 	for _, in := range tk.inputs {
-		parent := in.(*taskInput).tk
-		pout := in.(*taskInput).Output
-		pnode, _ := nc.Get(parent)
-		edge, ok := ec.Get(node, pnode, pout)
-		if !ok {
-			panic(fmt.Errorf("dupliacte reference: %v(%v) => %v", pnode.Name(), pout.String(), node.Name()))
+		for _, dep := range resolveDependentInputs(in) {
+			ti := dep.(*taskInput)
+			pnode, created := nc.Get(ti.tk)
+			edge, _ := ec.Get(node, pnode, ti.Output)
+			node.AddEdge(edge)
+			if created {
+				walk(ec, nc, ti.tk)
+			}
 		}
-		node.AddEdge(edge)
-		walk(ec, nc, parent)
 	}
 }
+
+// sortTasks returns the tasks on which tk depends, including tk itself, in dependency order.
+// Each task appears after all tasks it requires.
+func sortTasks(tk *task) []*task {
+	var (
+		sorted  []*task
+		visited = map[*task]bool{}
+		visit   func(tk *task)
+	)
+	visit = func(tk *task) {
+		if visited[tk] {
+			return
+		}
+		visited[tk] = true
+		for _, in := range tk.inputs {
+			for _, parent := range in.(TaskInput).Tasks() {
+				visit(parent)
+			}
+		}
+		sorted = append(sorted, tk)
+	}
+	visit(tk)
+	return sorted
+}
@@ -48,13 +48,15 @@ func CombineInputs(ins ...Input) Input {
 		}
 		tasks = append(tasks, in.(TaskInput).Tasks()...)
 	}
-	ch := make(chan interface{})
+	out := NewChannelOutput("combined-inputs", make(chan interface{}))
 	go func() {
-		defer close(ch)
+		defer out.Close()
 		for {
 			i, v, ok := reflect.Select(cases)
 			if ok {
-				ch <- v.Interface()
+				if err := out.Write(v.Interface()); err != nil {
+					return
+				}
 			} else {
 				newCases := []reflect.SelectCase{}
 				for j, cs := range cases {
@@ -72,10 +74,7 @@ func CombineInputs(ins ...Input) Input {
 	return &combinedTaskInput{
 		tks:    tasks,
 		inputs: ins,
-		Output: &ChannelOutput{
-			ch:   ch,
-			name: "combined-inputs",
-		},
+		Output: out,
 	}
 }
 
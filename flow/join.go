@@ -0,0 +1,226 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrUnsortedInput is returned by a sort-merge join when an input is not sorted by the key
+var ErrUnsortedInput = errors.New("input is not sorted by the key")
+
+// JoinMode decides which values are written when a key has no match in the other input
+type JoinMode int
+
+const (
+	// InnerJoin writes only the pairs of the values whose keys match
+	InnerJoin JoinMode = iota
+	// LeftJoin also writes the left values which have no match, with nil Right
+	LeftJoin
+	// FullOuterJoin also writes the values of either input which have no match, with nil Left or Right
+	FullOuterJoin
+)
+
+// Joined is a pair of values joined by Join
+type Joined struct {
+	Key   string
+	Left  interface{}
+	Right interface{}
+}
+
+// WithSortMergeJoin makes Join merge the inputs, which must be sorted by the keys in ascending order of strings,
+// such as FileOutputs written in the order of the keys.
+// Only the values of a key are held in memory, so it can join inputs which don't fit in memory.
+func WithSortMergeJoin() Options {
+	return func(opts *options) {
+		opts.SortMergeJoin = true
+	}
+}
+
+// Join returns a task which joins the values of left and right by the keys returned by leftKey and rightKey,
+// and writes Joined for each pair of the values with the same key, and for the values without a match according to mode.
+// By default, it is a hash join which reads all values of right into memory first, then streams left,
+// so right should be the smaller input. With WithSortMergeJoin, it merges the sorted inputs instead.
+// The hash join blocks if left and right are streamed from the same task, such as the consumers of a BroadcastOutput,
+// because that task cannot write the rest of right until left is read, so Flow.Validate rejects it.
+// Use WithSortMergeJoin or write either input to a FileOutput in that case.
+// The values are written to all outputs passed by WithOutputs, or to a new ChannelOutput, like Map.
+// The join runs on one worker.
+func Join(name string, left, right Input, leftKey, rightKey func(interface{}) string, mode JoinMode, opts ...Options) Task {
+	op := defaultOptions()
+	for _, opt := range opts {
+		opt(op)
+	}
+	j := &joiner{leftKey: leftKey, rightKey: rightKey, mode: mode}
+	if op.SortMergeJoin {
+		return streamTask(name, []Input{left, right}, WithProcessorContext(j.mergeJoin), append(opts, WithWorker(1)))
+	}
+	return streamTask(name, []Input{left, right}, WithProcessorContext(j.hashJoin), append(opts, WithWorker(1), withHashJoin()))
+}
+
+// withHashJoin marks the task which reads all values of the second input before the first one
+func withHashJoin() Options {
+	return func(opts *options) {
+		opts.HashJoin = true
+	}
+}
+
+type joiner struct {
+	leftKey, rightKey func(interface{}) string
+	mode              JoinMode
+}
+
+// receive reads the next value of ch, and returns false when ch is closed
+func receive(ctx context.Context, ch chan interface{}) (interface{}, bool, error) {
+	select {
+	case v, ok := <-ch:
+		return v, ok, nil
+	case <-ctx.Done():
+		return nil, false, context.Cause(ctx)
+	}
+}
+
+func (j *joiner) hashJoin(ctx context.Context, tk Task) error {
+	type entry struct {
+		v       interface{}
+		matched bool
+	}
+	table := map[string][]*entry{}
+	var keys []string // keys of table in the order of right, to write the unmatched values in order
+	rch := tk.In(1).Channel()
+	for {
+		v, ok, err := receive(ctx, rch)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		k := j.rightKey(v)
+		if _, ok := table[k]; !ok {
+			keys = append(keys, k)
+		}
+		table[k] = append(table[k], &entry{v: v})
+	}
+	lch := tk.In(0).Channel()
+	for {
+		v, ok, err := receive(ctx, lch)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		k := j.leftKey(v)
+		es, found := table[k]
+		if !found && j.mode != InnerJoin {
+			if err := writeAll(tk, Joined{Key: k, Left: v}); err != nil {
+				return err
+			}
+		}
+		for _, e := range es {
+			e.matched = true
+			if err := writeAll(tk, Joined{Key: k, Left: v, Right: e.v}); err != nil {
+				return err
+			}
+		}
+	}
+	if j.mode != FullOuterJoin {
+		return nil
+	}
+	for _, k := range keys {
+		for _, e := range table[k] {
+			if e.matched {
+				continue
+			}
+			if err := writeAll(tk, Joined{Key: k, Right: e.v}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortedReader reads the values of an input sorted by the key
+type sortedReader struct {
+	in  Input
+	ch  chan interface{}
+	key func(interface{}) string
+
+	v   interface{}
+	k   string
+	ok  bool
+	err error
+}
+
+// next reads the next value, and fails if its key is less than the previous one
+func (r *sortedReader) next(ctx context.Context) error {
+	prev, wasOK := r.k, r.ok
+	v, ok, err := receive(ctx, r.ch)
+	if err != nil {
+		return err
+	}
+	r.v, r.ok = v, ok
+	if !ok {
+		return nil
+	}
+	r.k = r.key(v)
+	if wasOK && r.k < prev {
+		return fmt.Errorf("%w: %v has %q after %q", ErrUnsortedInput, r.in.String(), r.k, prev)
+	}
+	return nil
+}
+
+func (j *joiner) mergeJoin(ctx context.Context, tk Task) error {
+	l := &sortedReader{in: tk.In(0), ch: tk.In(0).Channel(), key: j.leftKey}
+	r := &sortedReader{in: tk.In(1), ch: tk.In(1).Channel(), key: j.rightKey}
+	if err := l.next(ctx); err != nil {
+		return err
+	}
+	if err := r.next(ctx); err != nil {
+		return err
+	}
+	for l.ok || r.ok {
+		switch {
+		case !r.ok || (l.ok && l.k < r.k):
+			if j.mode != InnerJoin {
+				if err := writeAll(tk, Joined{Key: l.k, Left: l.v}); err != nil {
+					return err
+				}
+			}
+			if err := l.next(ctx); err != nil {
+				return err
+			}
+		case !l.ok || r.k < l.k:
+			if j.mode == FullOuterJoin {
+				if err := writeAll(tk, Joined{Key: r.k, Right: r.v}); err != nil {
+					return err
+				}
+			}
+			if err := r.next(ctx); err != nil {
+				return err
+			}
+		default:
+			// hold the right values of the key, and pair them with each left value of the key
+			k := l.k
+			var group []interface{}
+			for r.ok && r.k == k {
+				group = append(group, r.v)
+				if err := r.next(ctx); err != nil {
+					return err
+				}
+			}
+			for l.ok && l.k == k {
+				for _, rv := range group {
+					if err := writeAll(tk, Joined{Key: k, Left: l.v, Right: rv}); err != nil {
+						return err
+					}
+				}
+				if err := l.next(ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
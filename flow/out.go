@@ -1,6 +1,17 @@
 package flow
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrClosedOutput    = errors.New("cannot write to closed output")
+	ErrReadOnlyOutput  = errors.New("cannot write to read-only output")
+	ErrDestroyedOutput = errors.New("cannot write to destroyed output")
+)
 
 // Output is output interface
 type Output interface {
@@ -17,6 +28,115 @@ type Output interface {
 	String() string
 }
 
+// Canceler is implemented by outputs which can unblock their readers and writers when a flow is canceled.
+// err is the reason of the cancellation and it is returned from the blocked operations.
+type Canceler interface {
+	Cancel(err error)
+}
+
+// Recreator is implemented by outputs which can be written again from scratch after Destroy
+type Recreator interface {
+	Recreate() error
+}
+
+// Rewinder is implemented by outputs which can be read again from the beginning
+type Rewinder interface {
+	Rewind() error
+}
+
+// ErrReporter is implemented by outputs whose reader channel can be closed by an error,
+// such as a failed download or a record which cannot be decoded.
+// A task which reads such an output fails with the error.
+type ErrReporter interface {
+	// Err returns the error which closed the channel returned by Channel
+	Err() error
+}
+
+// Locator is implemented by outputs which are persisted somewhere, such as a local file or an S3 object
+type Locator interface {
+	// Location returns the path or the URL of the output
+	Location() string
+}
+
+type outputOptions struct {
+	Compression     Compression
+	Framing         Framing
+	MultipartUpload bool
+	PartSize        int64
+}
+
+// OutputOptions configures file and S3 outputs
+type OutputOptions func(*outputOptions)
+
+// WithCompression sets the compression of the output instead of detecting it from the extension
+func WithCompression(c Compression) OutputOptions {
+	return func(opts *outputOptions) {
+		opts.Compression = c
+	}
+}
+
+// WithFraming sets how the records of the output are delimited, instead of the default of the serializer.
+// For example, WithFraming(LengthPrefixFraming) writes records which may contain newlines.
+// The readers of the output must use the same framing.
+func WithFraming(f Framing) OutputOptions {
+	return func(opts *outputOptions) {
+		opts.Framing = f
+	}
+}
+
+func newOutputOptions(path string, opts []OutputOptions) *outputOptions {
+	op := &outputOptions{Compression: compressionOf(path)}
+	for _, opt := range opts {
+		opt(op)
+	}
+	if op.Compression == nil {
+		op.Compression = NoCompression
+	}
+	return op
+}
+
+// serializer returns srz, or DefaultSerializer if srz is nil, with the framing of the options
+func (op *outputOptions) serializer(srz *Serializer) *Serializer {
+	if srz == nil {
+		srz = DefaultSerializer
+	}
+	if op.Framing == nil {
+		return srz
+	}
+	c := *srz
+	c.recordFraming = op.Framing
+	return &c
+}
+
+// taskBinder is implemented by outputs which provide the inputs of their consumers, such as BroadcastOutput.
+// NewTask binds them to the task which writes them.
+type taskBinder interface {
+	bindTask(tk *task)
+}
+
+// unwrapOutput returns the innermost output which is wrapped by task inputs or other wrappers such as TypedOutput
+func unwrapOutput(out Output) Output {
+	for {
+		switch o := out.(type) {
+		case *taskInput:
+			out = o.Output
+		case *combinedTaskInput:
+			out = o.Output
+		case interface{ Unwrap() Output }:
+			out = o.Unwrap()
+		default:
+			return out
+		}
+	}
+}
+
+// cancelOutput cancels the output if it implements Canceler
+func cancelOutput(out Output, err error) {
+	if c, ok := unwrapOutput(out).(Canceler); ok {
+		c.Cancel(err)
+	}
+}
+
 type TaskInput interface {
 	Tasks() []*task
 	Output
@@ -25,6 +145,15 @@ type TaskInput interface {
 type taskInput struct {
 	tk *task
 	Output
+	written int64 // number of items written to the output
+}
+
+func (to *taskInput) Write(v interface{}) error {
+	if err := to.Output.Write(v); err != nil {
+		return err
+	}
+	atomic.AddInt64(&to.written, 1)
+	return nil
 }
 
 func (to *taskInput) Tasks() []*task {
@@ -34,18 +163,37 @@ func (to *taskInput) Tasks() []*task {
 type ChannelOutput struct {
 	ch   chan interface{}
 	name string
+
+	mu       sync.RWMutex
+	closed   bool
+	canceled chan struct{}
+	once     sync.Once
+	err      error
 }
 
 func NewChannelOutput(name string, ch chan interface{}) *ChannelOutput {
 	return &ChannelOutput{
-		ch:   ch,
-		name: name,
+		ch:       ch,
+		name:     name,
+		canceled: make(chan struct{}),
 	}
 }
 
 func (co *ChannelOutput) Write(v interface{}) error {
-	co.ch <- v
-	return nil
+	co.mu.RLock()
+	defer co.mu.RUnlock()
+	if co.closed {
+		if co.err != nil {
+			return co.err
+		}
+		return ErrClosedOutput
+	}
+	select {
+	case co.ch <- v:
+		return nil
+	case <-co.canceled:
+		return co.err
+	}
 }
 
 func (co *ChannelOutput) Read() (interface{}, error) {
@@ -57,10 +205,24 @@ func (co *ChannelOutput) Channel() chan interface{} {
 }
 
 func (co *ChannelOutput) Close() error {
-	close(co.ch)
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	if !co.closed {
+		co.closed = true
+		close(co.ch)
+	}
 	return nil
 }
 
+// Cancel unblocks the writers and closes the channel so that the readers can finish
+func (co *ChannelOutput) Cancel(err error) {
+	co.once.Do(func() {
+		co.err = err
+		close(co.canceled)
+	})
+	co.Close()
+}
+
 func (co *ChannelOutput) Destroy() {}
 
 func (co *ChannelOutput) IsSkip() bool {
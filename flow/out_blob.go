@@ -0,0 +1,338 @@
+package flow
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	ErrBlobNotFound = errors.New("ErrBlobNotFound")
+	errBlobAborted  = errors.New("blob is aborted")
+)
+
+// BlobStore stores blobs by key, such as the objects of an S3 bucket or the files of a local directory
+type BlobStore interface {
+	// Exists returns false without error if the blob does not exist
+	Exists(ctx context.Context, key string) (bool, error)
+	// Open returns a reader of the blob, or an error wrapping ErrBlobNotFound if the blob does not exist
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Create returns a writer of the blob.
+	// The blob is visible to the readers only after the writer is closed.
+	Create(ctx context.Context, key string) (BlobWriter, error)
+	// Delete deletes the blob. It does nothing if the blob does not exist.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys which start with the prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// BlobWriter writes a blob, which is committed on Close
+type BlobWriter interface {
+	io.WriteCloser
+	// Abort discards the blob. Close does nothing after Abort.
+	Abort() error
+}
+
+// BlobOutput writes records to a blob of a BlobStore, and its readers read the blob after it is closed
+type BlobOutput struct {
+	store BlobStore
+	key   string
+
+	srz *Serializer
+	mu  sync.RWMutex
+
+	closed   chan struct{} // writer closed channel
+	canceled chan struct{}
+	once     sync.Once
+	w        *fileWriter
+	buf      chan interface{}
+	stop     chan struct{} // reader stop channel
+	err      error         // error which closed the reader channel
+	isSkip   bool
+
+	// bw is aborted by Destroy without waiting for the writers, so it is guarded by its own lock
+	bw        BlobWriter
+	committed bool // the blob is written by this output, so Destroy deletes it
+	destroyed bool // the output is destroyed and not recreated yet, so late writes are rejected
+	bmu       sync.Mutex
+
+	compression Compression
+}
+
+func NewBlobOutput(store BlobStore, key string, srz *Serializer, opts ...OutputOptions) (*BlobOutput, error) {
+	return newBlobOutput(store, key, srz, newOutputOptions(key, opts))
+}
+
+func newBlobOutput(store BlobStore, key string, srz *Serializer, op *outputOptions) (*BlobOutput, error) {
+	srz = op.serializer(srz)
+	out := &BlobOutput{
+		store:    store,
+		key:      key,
+		srz:      srz,
+		closed:   make(chan struct{}),
+		canceled: make(chan struct{}),
+
+		compression: op.Compression,
+	}
+	exists, err := store.Exists(context.Background(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %v: %w", out.Location(), err)
+	}
+	out.isSkip = exists
+	return out, nil
+}
+
+// create starts writing the blob, which must be called with the lock.
+// The blob is created on the first write or Close, so a task which never runs leaves nothing in the store.
+func (out *BlobOutput) create() error {
+	bw, err := out.store.Create(context.Background(), out.key)
+	if err != nil {
+		return err
+	}
+	w, err := newFileWriter(bw, out.srz, out.compression, false)
+	if err != nil {
+		bw.Abort()
+		return err
+	}
+	out.bmu.Lock()
+	defer out.bmu.Unlock()
+	if out.destroyed {
+		bw.Abort()
+		return ErrDestroyedOutput
+	}
+	out.w = w
+	out.bw = bw
+	return nil
+}
+
+func (out *BlobOutput) isDestroyed() bool {
+	out.bmu.Lock()
+	defer out.bmu.Unlock()
+	return out.destroyed
+}
+
+func (out *BlobOutput) Write(v interface{}) error {
+	if out.isSkip {
+		return errors.New("cannot write to closed stream")
+	}
+	b, err := out.srz.Serialize(v)
+	if err != nil {
+		return err
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.isDestroyed() {
+		return ErrDestroyedOutput
+	}
+	if out.w == nil {
+		if err := out.create(); err != nil {
+			return err
+		}
+	}
+	return out.w.Write(out.srz.framing().Frame(b))
+}
+
+func (out *BlobOutput) Read() (interface{}, error) {
+	v, ok := <-out.Channel()
+	if !ok {
+		if err := out.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	return v, nil
+}
+
+// Channel streams the records of the blob as they are read.
+// If reading or decoding a record fails, the channel is closed and the error is reported by Err.
+func (out *BlobOutput) Channel() chan interface{} {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.buf != nil {
+		return out.buf
+	}
+	buf := make(chan interface{})
+	stop := make(chan struct{})
+	go func() {
+		defer close(buf)
+		if err := out.stream(buf, stop); err != nil {
+			Logger.Printf("file %v, occurred err: %v\n", out.Location(), err)
+			out.mu.Lock()
+			out.err = err
+			out.mu.Unlock()
+		}
+	}()
+	out.buf = buf
+	out.stop = stop
+	return out.buf
+}
+
+// stream reads the blob and sends the records to buf until the reader stops
+func (out *BlobOutput) stream(buf chan interface{}, stop chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-out.canceled:
+		case <-stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	// errors caused by stopping the reader are not reported
+	ignoreCanceled := func(err error) error {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	body, err := out.store.Open(ctx, out.key)
+	if err != nil {
+		return ignoreCanceled(err)
+	}
+	defer body.Close()
+	r, err := out.compression.NewReader(body)
+	if err != nil {
+		return ignoreCanceled(err)
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), MaxRecordSize+binary.MaxVarintLen64)
+	sc.Split(out.srz.framing().Split)
+	dec := out.srz.decoder()
+	for sc.Scan() {
+		v, ok, err := dec(sc.Bytes())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		select {
+		case buf <- v:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return ignoreCanceled(sc.Err())
+}
+
+// Err returns the error which closed the channel returned by Channel
+func (out *BlobOutput) Err() error {
+	out.mu.RLock()
+	defer out.mu.RUnlock()
+	return out.err
+}
+
+// Close commits the blob, which is created empty if nothing is written.
+// It fails without signaling Ready if the output is destroyed.
+func (out *BlobOutput) Close() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.isDestroyed() {
+		return ErrDestroyedOutput
+	}
+	defer close(out.closed)
+	if out.isSkip {
+		return nil
+	}
+	if out.w == nil {
+		if err := out.create(); err != nil {
+			return err
+		}
+	}
+	if err := out.w.Close(); err != nil {
+		return err
+	}
+	out.bmu.Lock()
+	defer out.bmu.Unlock()
+	out.bw = nil
+	out.committed = true
+	return nil
+}
+
+func (out *BlobOutput) IsSkip() bool {
+	return out.isSkip
+}
+
+func (out *BlobOutput) Ready() chan struct{} {
+	return out.closed
+}
+
+// Cancel stops sending the records to the reader
+func (out *BlobOutput) Cancel(err error) {
+	out.once.Do(func() {
+		close(out.canceled)
+	})
+}
+
+// Destroy aborts writing the blob, and deletes it if it is committed by this output.
+// A blob which existed before, such as the blob of a skipped output, is kept.
+// Ready is not signaled, so the readers never read the destroyed blob.
+// Writes fail until Recreate, so a worker which outlives the task cannot create the blob again.
+func (out *BlobOutput) Destroy() {
+	// abort before taking the lock to unblock the writers
+	out.bmu.Lock()
+	bw, committed := out.bw, out.committed
+	out.bw, out.committed = nil, false
+	out.destroyed = true
+	out.bmu.Unlock()
+	if bw != nil {
+		bw.Abort()
+	}
+	if committed {
+		out.delete()
+	}
+}
+
+func (out *BlobOutput) delete() {
+	if err := out.store.Delete(context.Background(), out.key); err != nil {
+		Logger.Printf("failed to delete %v: %v\n", out.Location(), err)
+	}
+}
+
+// Recreate makes the output writable again after Destroy.
+// If the blob existed before, which is the case of a forced output, it is deleted first.
+// The blob is created on the first write as well as the first time.
+func (out *BlobOutput) Recreate() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.isSkip {
+		out.delete()
+	}
+	out.w = nil
+	out.isSkip = false
+	out.bmu.Lock()
+	out.destroyed = false
+	out.bmu.Unlock()
+	return nil
+}
+
+// Rewind reads the blob again on the next call of Channel
+func (out *BlobOutput) Rewind() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.stop != nil {
+		close(out.stop)
+	}
+	out.buf = nil
+	out.stop = nil
+	out.err = nil
+	return nil
+}
+
+// Location returns the location of the blob if the store provides it, or the key
+func (out *BlobOutput) Location() string {
+	if l, ok := out.store.(interface{ Location(key string) string }); ok {
+		return l.Location(out.key)
+	}
+	return out.key
+}
+
+func (out *BlobOutput) String() string {
+	return fmt.Sprintf("%v (%T)", out.Location(), out)
+}
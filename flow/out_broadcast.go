@@ -0,0 +1,65 @@
+package flow
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// BroadcastOutput delivers every written value to each of its consumers.
+// Each consumer has its own buffer, so a slow consumer blocks the writer only when its buffer is full,
+// while the other consumers keep receiving the values written so far.
+// The consumers read it through In, after it is passed to WithOutputs of the writing task.
+type BroadcastOutput struct {
+	fanout
+}
+
+// NewBroadcastOutput returns a BroadcastOutput for n consumers, each of which buffers up to size values
+func NewBroadcastOutput(name string, n, size int) *BroadcastOutput {
+	bo := new(BroadcastOutput)
+	bo.init(bo, name, n, size)
+	return bo
+}
+
+// Tee is like NewBroadcastOutput with unbuffered consumers
+func Tee(name string, n int) *BroadcastOutput {
+	return NewBroadcastOutput(name, n, 0)
+}
+
+// Write blocks until all consumers receive v, or the consumers which don't are canceled
+func (bo *BroadcastOutput) Write(v interface{}) error {
+	bo.mu.RLock()
+	defer bo.mu.RUnlock()
+	if bo.closed {
+		return bo.writeErr()
+	}
+	cases := []reflect.SelectCase{{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(bo.canceled),
+	}}
+	// each consumer has a pair of cases: sending v, and being canceled
+	pending := make([]*consumerOutput, 0, len(bo.consumers))
+	for _, c := range bo.consumers {
+		if c.isCanceled() {
+			continue
+		}
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(c.ch), Send: reflect.ValueOf(&v).Elem()},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.canceled)},
+		)
+		pending = append(pending, c)
+	}
+	for len(pending) > 0 {
+		i, _, _ := reflect.Select(cases)
+		if i == 0 {
+			return bo.err
+		}
+		j := (i - 1) / 2
+		cases = append(cases[:1+j*2], cases[3+j*2:]...)
+		pending = append(pending[:j], pending[j+1:]...)
+	}
+	return nil
+}
+
+func (bo *BroadcastOutput) String() string {
+	return fmt.Sprintf("%v(%T)", bo.name, bo)
+}
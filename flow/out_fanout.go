@@ -0,0 +1,179 @@
+package flow
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// fanout holds the consumers of an output which feeds multiple inputs, such as BroadcastOutput and PartitionedOutput.
+// The consumers read it through In, after it is passed to WithOutputs of the writing task.
+type fanout struct {
+	name      string
+	tk        *task
+	consumers []*consumerOutput
+	inputs    []Input
+
+	mu       sync.RWMutex
+	closed   bool
+	canceled chan struct{}
+	once     sync.Once
+	err      error
+}
+
+// init creates n consumers, each of which buffers up to size values
+func (fo *fanout) init(parent Output, name string, n, size int) {
+	fo.name = name
+	fo.canceled = make(chan struct{})
+	for i := 0; i < n; i++ {
+		fo.consumers = append(fo.consumers, &consumerOutput{
+			parent:   parent,
+			mu:       &fo.mu,
+			idx:      i,
+			ch:       make(chan interface{}, size),
+			canceled: make(chan struct{}),
+		})
+	}
+}
+
+func (fo *fanout) bindTask(tk *task) {
+	fo.tk = tk
+	fo.inputs = make([]Input, len(fo.consumers))
+	for i, c := range fo.consumers {
+		fo.inputs[i] = &taskInput{tk: tk, Output: c}
+	}
+}
+
+// In returns the input of the i-th consumer.
+// It panics if the output is not passed to WithOutputs of a task yet.
+func (fo *fanout) In(i int) Input {
+	if fo.tk == nil {
+		panic(fmt.Sprintf("%v is not an output of any task", fo.name))
+	}
+	return fo.inputs[i]
+}
+
+// writeErr returns the error of writing to the closed output, which must be called with the lock
+func (fo *fanout) writeErr() error {
+	if fo.err != nil {
+		return fo.err
+	}
+	return ErrClosedOutput
+}
+
+func (fo *fanout) Read() (interface{}, error) {
+	return nil, fmt.Errorf("%v must be read through In", fo.name)
+}
+
+// Channel returns a closed channel. The consumers read the values through In.
+func (fo *fanout) Channel() chan interface{} {
+	ch := make(chan interface{})
+	close(ch)
+	return ch
+}
+
+// Close closes the channels of all consumers
+func (fo *fanout) Close() error {
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	if !fo.closed {
+		fo.closed = true
+		for _, c := range fo.consumers {
+			c.close()
+		}
+	}
+	return nil
+}
+
+// Cancel unblocks the writers and closes the channels of all consumers
+func (fo *fanout) Cancel(err error) {
+	fo.once.Do(func() {
+		fo.err = err
+		close(fo.canceled)
+	})
+	fo.Close()
+}
+
+func (fo *fanout) Destroy() {}
+
+func (fo *fanout) IsSkip() bool {
+	return false
+}
+
+func (fo *fanout) Ready() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// consumerOutput is the read-only output which is read by a consumer of a fanout
+type consumerOutput struct {
+	parent   Output
+	mu       *sync.RWMutex // lock of the fanout
+	idx      int
+	ch       chan interface{}
+	closed   bool // guarded by mu
+	canceled chan struct{}
+	once     sync.Once
+}
+
+func (c *consumerOutput) close() {
+	if !c.closed {
+		c.closed = true
+		close(c.ch)
+	}
+}
+
+// isCanceled returns true if the consumer is canceled, which must be checked with the read lock before sending to ch
+func (c *consumerOutput) isCanceled() bool {
+	select {
+	case <-c.canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *consumerOutput) Write(v interface{}) error {
+	return ErrReadOnlyOutput
+}
+
+func (c *consumerOutput) Read() (interface{}, error) {
+	v, ok := <-c.ch
+	if !ok {
+		return nil, io.EOF
+	}
+	return v, nil
+}
+
+func (c *consumerOutput) Channel() chan interface{} {
+	return c.ch
+}
+
+func (c *consumerOutput) Close() error {
+	return nil
+}
+
+// Cancel detaches the consumer, so that the writer no longer waits for it and the other consumers keep receiving values
+func (c *consumerOutput) Cancel(err error) {
+	c.once.Do(func() {
+		close(c.canceled)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.close()
+}
+
+func (c *consumerOutput) Destroy() {}
+
+func (c *consumerOutput) IsSkip() bool {
+	return false
+}
+
+func (c *consumerOutput) Ready() chan struct{} {
+	return c.parent.Ready()
+}
+
+func (c *consumerOutput) String() string {
+	return fmt.Sprintf("%v[%v]", c.parent.String(), c.idx)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
 )
 
@@ -24,6 +25,45 @@ type (
 type Serializer struct {
 	Serialize   SerializeFunc
 	Deserialize DeserializeFunc
+
+	// Header is written as the first record of each file if it is not nil
+	Header []byte
+	// DeserializeHeader is called with the first record of each file instead of Deserialize,
+	// and returns the DeserializeFunc for the rest of the records.
+	// If it is nil, the first record is deserialized by Deserialize as the others.
+	DeserializeHeader func([]byte) (DeserializeFunc, error)
+
+	// recordFraming is the default framing of the serializer, which is overridden by WithFraming of the output.
+	// If it is nil, LineFraming is used.
+	recordFraming Framing
+}
+
+func (srz *Serializer) framing() Framing {
+	if srz.recordFraming == nil {
+		return LineFraming
+	}
+	return srz.recordFraming
+}
+
+// decoder returns a function which deserializes the records of a file in order.
+// It returns false for the header record.
+func (srz *Serializer) decoder() func([]byte) (interface{}, bool, error) {
+	deserialize := srz.Deserialize
+	if srz.DeserializeHeader != nil {
+		deserialize = nil
+	}
+	return func(b []byte) (interface{}, bool, error) {
+		if deserialize == nil {
+			fn, err := srz.DeserializeHeader(b)
+			if err != nil {
+				return nil, false, err
+			}
+			deserialize = fn
+			return nil, false, nil
+		}
+		v, err := deserialize(b)
+		return v, true, err
+	}
 }
 
 func defaultSerialize(iv interface{}) ([]byte, error) {
@@ -44,41 +84,44 @@ func defaultDeserialize(b []byte) (interface{}, error) {
 // streaming I/O
 type FileStreaming struct {
 	path   string
-	w      *os.File
+	w      *fileWriter
 	t      *tail
+	dec    func([]byte) (interface{}, bool, error)
 	buf    chan interface{}
+	err    error // error which closed the reader channel
 	isSkip bool
 	srz    *Serializer
 	mu     sync.RWMutex
+
+	compression Compression
 }
 
-func NewFileStreaming(path string, srz *Serializer) (*FileStreaming, error) {
+func NewFileStreaming(path string, srz *Serializer, opts ...OutputOptions) (*FileStreaming, error) {
 	var (
-		w   *os.File
+		w   *fileWriter
 		err error
 	)
+	op := newOutputOptions(path, opts)
+	srz = op.serializer(srz)
 	isSkip := IsFileExists(path)
 	if !isSkip {
-		if w, err = os.Create(path); err != nil {
+		if w, err = createFile(path, srz, op.Compression, true); err != nil {
 			return nil, err
 		}
 	}
-	r, err := os.Open(path)
+	t, err := newCompressedFileTail(path, srz.framing().Split, op.Compression)
 	if err != nil {
 		return nil, err
 	}
-	t := newTail(r)
-	go t.Run()
-
-	if srz == nil {
-		srz = DefaultSerializer
-	}
 	return &FileStreaming{
 		path:   path,
 		w:      w,
 		t:      t,
+		dec:    srz.decoder(),
 		srz:    srz,
 		isSkip: isSkip,
+
+		compression: op.Compression,
 	}, nil
 }
 
@@ -92,22 +135,25 @@ func (fs *FileStreaming) Write(v interface{}) error {
 	}
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	_, err = fs.w.Write(append(b, '\n'))
-	return err
+	return fs.w.Write(fs.srz.framing().Frame(b))
 }
 
 func (fs *FileStreaming) Read() (interface{}, error) {
-	line := <-fs.t.Lines
-	if line == nil {
-		return nil, io.EOF
-	}
-	if line.Error != nil {
-		if line.Error == io.EOF {
-			close(fs.buf)
+	for {
+		line := <-fs.t.Lines
+		if line == nil {
+			return nil, io.EOF
+		}
+		if line.Error != nil {
+			if line.Error == io.EOF {
+				close(fs.buf)
+			}
+			return nil, line.Error
+		}
+		if v, ok, err := fs.dec(line.Text); ok || err != nil {
+			return v, err
 		}
-		return nil, line.Error
 	}
-	return fs.srz.Deserialize([]byte(line.Text))
 }
 
 func (fs *FileStreaming) Channel() chan interface{} {
@@ -116,22 +162,33 @@ func (fs *FileStreaming) Channel() chan interface{} {
 	if fs.buf != nil {
 		return fs.buf
 	}
+	t, dec := fs.t, fs.dec
 	buf := make(chan interface{})
 	go func() {
-		for line := range fs.t.Lines {
+		defer close(buf)
+		fail := func(err error) {
+			Logger.Printf("file %v, occurred err: %v\n", fs.path, err)
+			fs.mu.Lock()
+			fs.err = err
+			fs.mu.Unlock()
+		}
+		for line := range t.Lines {
 			if line.Error == io.EOF {
 				Logger.Printf("closed %v\n", fs.path)
-				close(buf)
 				return
 			} else if line.Error != nil {
-				Logger.Printf("file %v, occurred err: %v\n", fs.path, line.Error)
-				continue
+				fail(line.Error)
+				return
 			}
-			if b, err := fs.srz.Deserialize(line.Text); err != nil {
-				Logger.Printf("file: %v, deserialize error: %v\n", fs.path, err)
+			if b, ok, err := dec(line.Text); err != nil {
+				fail(err)
 				return
-			} else {
-				buf <- b
+			} else if ok {
+				select {
+				case buf <- b:
+				case <-t.canceled:
+					return
+				}
 			}
 		}
 	}()
@@ -139,6 +196,13 @@ func (fs *FileStreaming) Channel() chan interface{} {
 	return buf
 }
 
+// Err returns the error which closed the channel returned by Channel, such as a record which cannot be decoded
+func (fs *FileStreaming) Err() error {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.err
+}
+
 func (fs *FileStreaming) Close() error {
 	defer fs.t.Stop()
 	if fs.w != nil {
@@ -147,11 +211,40 @@ func (fs *FileStreaming) Close() error {
 	return nil
 }
 
+// Cancel stops reading the file
+func (fs *FileStreaming) Cancel(err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	fs.t.Cancel()
+}
+
 func (fs *FileStreaming) Destroy() {
 	fs.Close()
 	os.Remove(fs.path)
 }
 
+// Recreate creates an empty file again after Destroy
+func (fs *FileStreaming) Recreate() error {
+	w, err := createFile(fs.path, fs.srz, fs.compression, true)
+	if err != nil {
+		return err
+	}
+	t, err := newCompressedFileTail(fs.path, fs.srz.framing().Split, fs.compression)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.w = w
+	fs.t = t
+	fs.dec = fs.srz.decoder()
+	fs.buf = nil
+	fs.err = nil
+	fs.isSkip = false
+	return nil
+}
+
 func (fs *FileStreaming) IsSkip() bool {
 	return fs.isSkip
 }
@@ -162,49 +255,70 @@ func (fs *FileStreaming) Ready() chan struct{} {
 	return ch
 }
 
+func (fs *FileStreaming) Location() string {
+	return fs.path
+}
+
 func (fs *FileStreaming) String() string {
 	return fmt.Sprintf("%v(%T)", fs.path, fs)
 }
 
+// FileOutput writes records to a file, and its readers read the file after it is closed.
+// Each record is delimited by the framing set by WithFraming, or the framing of the serializer.
+// With the default serializer, the records are written as they are and read line by line,
+// so the writer terminates each record by a newline unless WithFraming(LineFraming) is set.
+// The records are written to a temporary file in the same directory, which is created on the first write
+// and renamed to the path on Close, so the path never holds a partially written file.
 type FileOutput struct {
-	path   string
-	w      *os.File      // writer
-	closed chan struct{} // writer closed channel
-	t      *tail
-	buf    chan interface{} // reader channel
-	isSkip bool
-	srz    *Serializer
-	mu     sync.RWMutex
+	path      string
+	w         *fileWriter   // writer of the temporary file
+	closed    chan struct{} // writer closed channel
+	canceled  chan struct{}
+	once      sync.Once
+	t         *tail // tail of the file, which is opened on Close
+	dec       func([]byte) (interface{}, bool, error)
+	buf       chan interface{} // reader channel
+	err       error            // error which closed the reader channel
+	isSkip    bool
+	committed bool // the file is written by this output, so Destroy removes it
+	destroyed bool // the output is destroyed and not recreated yet, so late writes are rejected
+	srz       *Serializer
+	mu        sync.RWMutex
+
+	compression Compression
 }
 
-func NewFileOutput(path string, srz *Serializer) (*FileOutput, error) {
-	var (
-		w   *os.File
-		err error
-	)
-	isSkip := IsFileExists(path)
-	if !isSkip {
-		if w, err = os.Create(path); err != nil {
-			return nil, err
-		}
+func NewFileOutput(path string, srz *Serializer, opts ...OutputOptions) (*FileOutput, error) {
+	op := newOutputOptions(path, opts)
+	if (srz == nil || srz == DefaultSerializer) && op.Framing == nil {
+		op.Framing = rawFraming{}
 	}
-	r, err := os.Open(path)
+	srz = op.serializer(srz)
+	return &FileOutput{
+		path:     path,
+		dec:      srz.decoder(),
+		srz:      srz,
+		isSkip:   IsFileExists(path),
+		closed:   make(chan struct{}),
+		canceled: make(chan struct{}),
+
+		compression: op.Compression,
+	}, nil
+}
+
+// createTempFile creates a temporary file next to the path
+func createTempFile(path string, srz *Serializer, c Compression) (*fileWriter, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return nil, err
 	}
-	t := newTail(r)
-	go t.Run()
-	if srz == nil {
-		srz = DefaultSerializer
+	w, err := newFileWriter(f, srz, c, false)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
 	}
-	return &FileOutput{
-		path:   path,
-		w:      w,
-		t:      t,
-		srz:    srz,
-		isSkip: isSkip,
-		closed: make(chan struct{}),
-	}, nil
+	return w, nil
 }
 
 func (out *FileOutput) Write(v interface{}) error {
@@ -215,64 +329,156 @@ func (out *FileOutput) Write(v interface{}) error {
 	if err != nil {
 		return err
 	}
+	b = out.srz.framing().Frame(b)
 	out.mu.Lock()
 	defer out.mu.Unlock()
-	_, err = out.w.Write(b)
-	return err
+	if out.destroyed {
+		return ErrDestroyedOutput
+	}
+	if out.w == nil {
+		if out.w, err = createTempFile(out.path, out.srz, out.compression); err != nil {
+			return err
+		}
+	}
+	return out.w.Write(b)
 }
 
+// tail waits until the output is closed, and returns the tail of the file.
+// It returns nil if the output is canceled, or the file could not be closed.
+func (out *FileOutput) tail() *tail {
+	select {
+	case <-out.closed:
+	case <-out.canceled:
+		return nil
+	}
+	out.mu.RLock()
+	defer out.mu.RUnlock()
+	return out.t
+}
+
+// Read returns the next record. It waits until the output is closed.
 func (out *FileOutput) Read() (interface{}, error) {
-	line := <-out.t.Lines
-	if line == nil {
+	t := out.tail()
+	if t == nil {
 		return nil, io.EOF
 	}
-	if line.Error != nil {
-		if line.Error == io.EOF {
-			close(out.buf)
+	for {
+		line := <-t.Lines
+		if line == nil {
+			return nil, io.EOF
+		}
+		if line.Error != nil {
+			if line.Error == io.EOF {
+				close(out.buf)
+			}
+			return nil, line.Error
+		}
+		if v, ok, err := out.dec(line.Text); ok || err != nil {
+			return v, err
 		}
-		return nil, line.Error
 	}
-	return out.srz.Deserialize([]byte(line.Text))
 }
 
+// Channel streams the records after the output is closed.
+// If reading or decoding a record fails, the channel is closed and the error is reported by Err.
 func (out *FileOutput) Channel() chan interface{} {
 	out.mu.Lock()
 	defer out.mu.Unlock()
 	if out.buf != nil {
 		return out.buf
 	}
-	out.buf = make(chan interface{})
+	dec := out.dec
+	buf := make(chan interface{})
 	go func() {
-		for line := range out.t.Lines {
+		defer close(buf)
+		t := out.tail()
+		if t == nil {
+			return
+		}
+		fail := func(err error) {
+			Logger.Printf("file %v, occurred err: %v\n", out.path, err)
+			out.mu.Lock()
+			out.err = err
+			out.mu.Unlock()
+		}
+		for line := range t.Lines {
 			if line.Error == io.EOF {
 				Logger.Printf("closed %v\n", out.path)
-				close(out.buf)
 				return
 			} else if line.Error != nil {
-				Logger.Printf("file %v, occurred err: %v\n", out.path, line.Error)
-				continue
+				fail(line.Error)
+				return
 			}
-			if b, err := out.srz.Deserialize(line.Text); err != nil {
-				Logger.Printf("file %v, deserialize error: %v\n", out.path, err)
+			if b, ok, err := dec(line.Text); err != nil {
+				fail(err)
 				return
-			} else {
-				out.buf <- b
+			} else if ok {
+				select {
+				case buf <- b:
+				case <-t.canceled:
+					return
+				}
 			}
 		}
 	}()
+	out.buf = buf
 	return out.buf
 }
 
+// Err returns the error which closed the channel returned by Channel, such as a record which cannot be decoded
+func (out *FileOutput) Err() error {
+	out.mu.RLock()
+	defer out.mu.RUnlock()
+	return out.err
+}
+
 func (out *FileOutput) IsSkip() bool {
 	return out.isSkip
 }
 
+// Close renames the temporary file to the path, and opens the file for the readers.
+// The temporary file is removed if it cannot be renamed.
+// It fails without signaling Ready if the output is destroyed.
 func (out *FileOutput) Close() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.destroyed {
+		return ErrDestroyedOutput
+	}
 	defer close(out.closed)
-	defer out.t.Stop()
-	if out.w != nil {
-		return out.w.Close()
+	if !out.isSkip {
+		if err := out.commit(); err != nil {
+			return err
+		}
 	}
+	t, err := newCompressedFileTail(out.path, out.srz.framing().Split, out.compression)
+	if err != nil {
+		return err
+	}
+	t.Stop()
+	out.t = t
+	return nil
+}
+
+// commit closes the temporary file, which is created if nothing is written, and renames it to the path
+func (out *FileOutput) commit() error {
+	w := out.w
+	if w == nil {
+		var err error
+		if w, err = createTempFile(out.path, out.srz, out.compression); err != nil {
+			return err
+		}
+	}
+	out.w = nil
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), out.path); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	out.committed = true
 	return nil
 }
 
@@ -280,9 +486,83 @@ func (out *FileOutput) Ready() chan struct{} {
 	return out.closed
 }
 
+// Cancel stops reading the file
+func (out *FileOutput) Cancel(err error) {
+	out.once.Do(func() {
+		close(out.canceled)
+	})
+	out.mu.RLock()
+	defer out.mu.RUnlock()
+	if out.t != nil {
+		out.t.Cancel()
+	}
+}
+
+// Destroy removes the temporary file, and the file if it is written by this output.
+// A file which existed before, such as the file of a skipped output, is kept.
+// Ready is not signaled, so the readers never read the destroyed file.
+// Writes fail until Recreate, so a worker which outlives the task cannot leave a temporary file.
 func (out *FileOutput) Destroy() {
-	out.Close()
-	os.Remove(out.path)
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.destroyed = true
+	if out.w != nil {
+		out.w.Close()
+		os.Remove(out.w.Name())
+		out.w = nil
+	}
+	if out.t != nil {
+		out.t.Cancel()
+	}
+	if out.committed {
+		os.Remove(out.path)
+		out.committed = false
+	}
+}
+
+// Recreate makes the output writable again after Destroy.
+// If the file existed before, which is the case of a forced output, it is removed first.
+// The temporary file is created on the first write as well as the first time.
+func (out *FileOutput) Recreate() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.isSkip {
+		if err := os.Remove(out.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	out.w = nil
+	out.t = nil
+	out.dec = out.srz.decoder()
+	out.buf = nil
+	out.err = nil
+	out.isSkip = false
+	out.destroyed = false
+	return nil
+}
+
+// Rewind reads the file again from the beginning.
+// It must be called after the output is closed.
+func (out *FileOutput) Rewind() error {
+	t, err := newCompressedFileTail(out.path, out.srz.framing().Split, out.compression)
+	if err != nil {
+		return err
+	}
+	t.Stop()
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.t != nil {
+		out.t.Cancel()
+	}
+	out.t = t
+	out.dec = out.srz.decoder()
+	out.buf = nil
+	out.err = nil
+	return nil
+}
+
+func (out *FileOutput) Location() string {
+	return out.path
 }
 
 func (out *FileOutput) String() string {
@@ -0,0 +1,68 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// ErrCanceledPartition is returned by PartitionedOutput.Write when the consumer of the partition is canceled
+var ErrCanceledPartition = errors.New("partition is canceled")
+
+// PartitionedOutput routes each written value to one of its partitions by the hash of the key of the value,
+// so all values with the same key are read by the same consumer.
+// A downstream task reads a partition through In(i), and the workers of one task can read
+// all partitions in parallel by tk.In(WorkerIndex(ctx)).
+// Every partition must be read, otherwise the writer blocks forever, so Flow.Validate fails
+// if a partition is not an input of any task, or a task has fewer workers than the partitions it reads.
+type PartitionedOutput struct {
+	fanout
+	key func(interface{}) string
+}
+
+// NewPartitionedOutput returns a PartitionedOutput with n partitions, each of which buffers up to size values.
+// It panics if n is not positive or key is nil.
+func NewPartitionedOutput(name string, n, size int, key func(interface{}) string) *PartitionedOutput {
+	if n <= 0 {
+		panic(fmt.Sprintf("%v must have at least one partition: %v", name, n))
+	}
+	if key == nil {
+		panic(fmt.Sprintf("%v has no key function", name))
+	}
+	po := &PartitionedOutput{key: key}
+	po.init(po, name, n, size)
+	return po
+}
+
+// Partition returns the index of the partition which v is routed to
+func (po *PartitionedOutput) Partition(v interface{}) int {
+	h := fnv.New32a()
+	h.Write([]byte(po.key(v)))
+	return int(h.Sum32() % uint32(len(po.consumers)))
+}
+
+// Write blocks until the consumer of the partition receives v.
+// If the consumer is canceled, v cannot be delivered, and an error wrapping ErrCanceledPartition is returned.
+func (po *PartitionedOutput) Write(v interface{}) error {
+	c := po.consumers[po.Partition(v)]
+	po.mu.RLock()
+	defer po.mu.RUnlock()
+	if po.closed {
+		return po.writeErr()
+	}
+	if c.isCanceled() {
+		return fmt.Errorf("%w: %v", ErrCanceledPartition, c.String())
+	}
+	select {
+	case c.ch <- v:
+		return nil
+	case <-c.canceled:
+		return fmt.Errorf("%w: %v", ErrCanceledPartition, c.String())
+	case <-po.canceled:
+		return po.err
+	}
+}
+
+func (po *PartitionedOutput) String() string {
+	return fmt.Sprintf("%v(%T)", po.name, po)
+}
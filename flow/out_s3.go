@@ -1,33 +1,38 @@
 package flow
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
-	"sync"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// S3Output is a BlobOutput which writes records to an S3 object
 type S3Output struct {
-	bucket     string
-	path       string
-	client     *s3.S3
-	downloader *s3manager.Downloader
-	uploader   *s3manager.Uploader
-
-	srz *Serializer
-	mu  sync.RWMutex
+	*BlobOutput
+}
 
-	closed chan struct{} // writer closed channel
-	f      *os.File
-	buf    chan interface{}
-	isSkip bool
+// WithMultipartUpload makes S3Output write the records straight into a multipart upload
+// instead of staging them in a temporary file.
+// partSize is the size of each part, which must be at least s3manager.MinUploadPartSize.
+// If it is zero, the default of s3manager.Uploader is used.
+func WithMultipartUpload(partSize int64) OutputOptions {
+	return func(opts *outputOptions) {
+		opts.MultipartUpload = true
+		opts.PartSize = partSize
+	}
 }
 
 // pathToLocalはs3 keyをlocal pathに変換します
@@ -39,137 +44,222 @@ func pathToLocal(dir, path string) string {
 	return lpath
 }
 
-func NewS3Output(c client.ConfigProvider, bucket, path string, srz *Serializer) (*S3Output, error) {
-	if srz == nil {
-		srz = DefaultSerializer
-	}
-	out := &S3Output{
-		client:     s3.New(c),
-		downloader: s3manager.NewDownloader(c),
-		uploader:   s3manager.NewUploader(c),
-		bucket:     bucket,
-		path:       path,
-		srz:        srz,
-		closed:     make(chan struct{}),
-	}
-	if out.isSkip = out.isS3FileExists(); !out.isSkip {
-		f, err := ioutil.TempFile("", filepath.Base(path))
-		if err != nil {
-			return nil, err
-		}
-		out.f = f
+func NewS3Output(c client.ConfigProvider, bucket, path string, srz *Serializer, opts ...OutputOptions) (*S3Output, error) {
+	op := newOutputOptions(path, opts)
+	store := NewS3BlobStore(c, bucket)
+	store.MultipartUpload = op.MultipartUpload
+	store.PartSize = op.PartSize
+	out, err := newBlobOutput(store, path, srz, op)
+	if err != nil {
+		return nil, err
 	}
-	return out, nil
+	return &S3Output{BlobOutput: out}, nil
 }
 
-func (out *S3Output) Read() (interface{}, error) {
-	return <-out.Channel(), nil
+func (out *S3Output) String() string {
+	return fmt.Sprintf("%v (%T)", out.Location(), out)
 }
 
-func (out *S3Output) Channel() chan interface{} {
-	out.mu.Lock()
-	defer out.mu.Unlock()
-	if out.buf != nil {
-		return out.buf
+// S3BlobStore stores blobs as the objects of an S3 bucket
+type S3BlobStore struct {
+	Client   s3iface.S3API
+	Uploader *s3manager.Uploader
+	Bucket   string
+
+	// MultipartUpload makes Create write the blob straight into a multipart upload
+	// instead of staging it in a temporary file
+	MultipartUpload bool
+	// PartSize is the size of each part of the multipart upload.
+	// If it is zero, the default of the uploader is used.
+	PartSize int64
+}
+
+func NewS3BlobStore(c client.ConfigProvider, bucket string) *S3BlobStore {
+	return &S3BlobStore{
+		Client:   s3.New(c),
+		Uploader: s3manager.NewUploader(c),
+		Bucket:   bucket,
 	}
-	out.buf = make(chan interface{})
-	go func() {
-		wbuf := aws.NewWriteAtBuffer([]byte{})
-		params := &s3.GetObjectInput{
-			Bucket: aws.String(out.bucket),
-			Key:    aws.String(out.path),
-		}
-		_, err := out.downloader.Download(wbuf, params, func(dw *s3manager.Downloader) {
-			dw.Concurrency = 5
-		})
-		if err != nil {
-			panic(err)
-		}
-		lines := bytes.Split(wbuf.Bytes(), []byte{'\n'})
-		lineNum := len(lines)
-		for i, line := range lines {
-			v, err := out.srz.Deserialize(line)
-			if err != nil {
-				Logger.Printf("file %v, deserialize error: %v\n", out.path, err)
-				continue
-			}
-			if i == lineNum-1 && len(line) == 0 {
-				break
-			}
-			out.buf <- v
-		}
-		close(out.buf)
-	}()
-	return out.buf
 }
 
-func (out *S3Output) Write(v interface{}) error {
-	b, err := out.srz.Serialize(v)
+// Exists checks whether the object exists by HeadObject.
+// It returns an error if the existence cannot be determined, such as when access is denied.
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if isS3NotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// Open returns the body of the object, which is streamed as it is read
+func (s *S3BlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return err
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("%w: %v: %v", ErrBlobNotFound, s.Location(key), err)
+		}
+		return nil, err
 	}
-	out.mu.Lock()
-	defer out.mu.Unlock()
-	_, err = out.f.Write(append(b, '\n'))
-	return err
+	return res.Body, nil
 }
 
-// isS3FileExists returns true if
-func (out *S3Output) isS3FileExists() bool {
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(out.bucket),
-		Key:    aws.String(out.path),
+// Create returns a writer which uploads the object on Close
+func (s *S3BlobStore) Create(ctx context.Context, key string) (BlobWriter, error) {
+	if s.MultipartUpload {
+		return s.startUpload(ctx, key), nil
 	}
-	_, err := out.client.GetObject(input)
+	f, err := ioutil.TempFile("", filepath.Base(key))
 	if err != nil {
-		return false
+		return nil, err
 	}
-	return true
+	return &s3StagedWriter{File: f, ctx: ctx, store: s, key: key}, nil
 }
 
-func (out *S3Output) Close() error {
-	defer close(out.closed)
-	if out.f != nil {
-		if err := out.commit(); err != nil {
-			return err
-		}
-		return out.f.Close()
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil && !isS3NotFound(err) {
+		return err
 	}
 	return nil
 }
 
-func (out *S3Output) commit() error {
-	f, err := os.Open(out.f.Name())
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	_, err = out.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(out.bucket),
-		Key:    aws.String(out.path),
-		Body:   f,
+	return keys, nil
+}
+
+func (s *S3BlobStore) Location(key string) string {
+	return fmt.Sprintf("s3://%v/%v", s.Bucket, strings.TrimPrefix(key, "/"))
+}
+
+func (s *S3BlobStore) upload(ctx context.Context, key string, body io.Reader) error {
+	_, err := s.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}, func(u *s3manager.Uploader) {
+		if s.PartSize > 0 {
+			u.PartSize = s.PartSize
+		}
+		u.LeavePartsOnError = false
 	})
-	if err != nil {
-		return err
+	return err
+}
+
+func (s *S3BlobStore) startUpload(ctx context.Context, key string) *s3Upload {
+	pr, pw := io.Pipe()
+	up := &s3Upload{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(up.done)
+		err := s.upload(ctx, key, pr)
+		// unblock the writers if the upload fails
+		pr.CloseWithError(err)
+		up.err = err
+	}()
+	return up
+}
+
+// isS3NotFound returns true if err means that the object does not exist
+func isS3NotFound(err error) bool {
+	var rf awserr.RequestFailure
+	if errors.As(err, &rf) && rf.StatusCode() == http.StatusNotFound {
+		return true
 	}
-	return nil
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		switch ae.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
+	return false
 }
 
-func (out *S3Output) IsSkip() bool {
-	return out.isSkip
+// s3Upload uploads the records written to the pipe by a multipart upload
+type s3Upload struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
 }
 
-func (out *S3Output) Ready() chan struct{} {
-	return out.closed
+func (up *s3Upload) Write(p []byte) (int, error) {
+	return up.pw.Write(p)
 }
 
-func (out *S3Output) Destroy() {
-	defer close(out.closed)
-	if out.f != nil {
-		out.f.Close()
+// Close waits for the upload to complete
+func (up *s3Upload) Close() error {
+	up.pw.Close()
+	<-up.done
+	return up.err
+}
+
+// Abort aborts the upload. The uploader fails to read the rest of the records,
+// and removes the uploaded parts by AbortMultipartUpload.
+// The context of the upload is not canceled, otherwise the request to abort would fail and leave the parts.
+func (up *s3Upload) Abort() error {
+	up.pw.CloseWithError(errBlobAborted)
+	<-up.done
+	return nil
+}
+
+// s3StagedWriter stages the object in a temporary file, and uploads it on Close
+type s3StagedWriter struct {
+	*os.File
+	ctx     context.Context
+	store   *S3BlobStore
+	key     string
+	aborted bool
+}
+
+// Close uploads the temporary file and removes it.
+// Failing to remove it is only logged, so that a committed object is never reported as a failure.
+func (w *s3StagedWriter) Close() error {
+	if w.aborted {
+		return nil
+	}
+	defer func() {
+		if err := os.Remove(w.Name()); err != nil {
+			Logger.Printf("failed to remove %v: %v\n", w.Name(), err)
+		}
+	}()
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	f, err := os.Open(w.Name())
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	return w.store.upload(w.ctx, w.key, f)
 }
 
-func (out *S3Output) String() string {
-	return fmt.Sprintf("s3://%v%v (%T)", out.bucket, out.path, out)
+func (w *s3StagedWriter) Abort() error {
+	w.aborted = true
+	w.File.Close()
+	return os.Remove(w.Name())
 }
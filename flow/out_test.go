@@ -1,6 +1,25 @@
 package flow
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
 
 func TestFileStreaming(t *testing.T) {
 	st, err := NewFileStreaming("/tmp/flow_fst.txt", nil)
@@ -22,3 +41,552 @@ func TestFileStreaming(t *testing.T) {
 		t.Errorf("%v != %v", s, "test1")
 	}
 }
+
+func TestJSONLinesSerializer(t *testing.T) {
+	type record struct {
+		Name  string
+		Count int
+	}
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	out, err := NewFileOutput(path, NewJSONLinesSerializer[record]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = out.Write(record{Name: "a\nb", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.Write(record{Name: "c", Count: 2}); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	var records []record
+	for v := range out.Channel() {
+		records = append(records, v.(record))
+	}
+	if len(records) != 2 || records[0].Name != "a\nb" || records[1].Count != 2 {
+		t.Errorf("unexpected records: %v", records)
+	}
+}
+
+func TestCSVSerializer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.csv")
+	out, err := NewFileOutput(path, NewCSVSerializer("name", "note"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = out.Write(map[string]string{"name": "a", "note": "multi\nline, \"quoted\""}); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.Write([]string{"b", ""}); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	// the columns are mapped by the header row of the file
+	in, err := NewFileOutput(path, NewCSVSerializer("note", "name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Close()
+	var records []map[string]string
+	for v := range in.Channel() {
+		records = append(records, v.(map[string]string))
+	}
+	if len(records) != 2 || records[0]["note"] != "multi\nline, \"quoted\"" || records[1]["name"] != "b" {
+		t.Errorf("unexpected records: %v", records)
+	}
+
+	// a record which cannot be decoded fails the reader, whether it is read from a file or a blob
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "bad.csv"), []byte("name,note\na,1\nb\nc,3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewFileOutput(filepath.Join(dir, "bad.csv"), NewCSVSerializer("name", "note"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := NewBlobOutput(NewDirBlobStore(dir), "bad.csv", NewCSVSerializer("name", "note"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []Output{file, blob} {
+		src := NewTask("source", WithOutputs(bad), WithProcessor(func(tk Task) error { return nil }))
+		var n int
+		reader := NewTask("reader", WithInputs(src.Out()), WithProcessor(func(tk Task) error {
+			for range tk.In().Channel() {
+				n++
+			}
+			return nil
+		}))
+		if _, err := Run(reader); err == nil || !strings.Contains(err.Error(), "wrong number of fields") || n != 1 {
+			t.Errorf("%v: unexpected result: %v records, %v", bad, n, err)
+		}
+	}
+}
+
+func TestGobSerializer(t *testing.T) {
+	type record struct {
+		Name string
+		Data []byte
+	}
+	path := filepath.Join(t.TempDir(), "records.gob")
+	out, err := NewFileOutput(path, NewGobSerializer[record]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{0, '\n', 0xff, '\r', '\n'}
+	if err = out.Write(record{Name: "a", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if err = out.Write(record{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	var records []record
+	for v := range out.Channel() {
+		records = append(records, v.(record))
+	}
+	if len(records) != 2 || !bytes.Equal(records[0].Data, data) || records[1].Name != "b" {
+		t.Errorf("unexpected records: %v", records)
+	}
+
+	// the framing is an option of the output, independent of the serializer
+	raw, err := NewFileOutput(filepath.Join(t.TempDir(), "records.bin"), nil, WithFraming(LengthPrefixFraming))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	var blobs [][]byte
+	for v := range raw.Channel() {
+		blobs = append(blobs, v.([]byte))
+	}
+	if len(blobs) != 1 || !bytes.Equal(blobs[0], data) {
+		t.Errorf("unexpected records: %q", blobs)
+	}
+}
+
+func TestGzipFileStreaming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.txt.gz")
+	st, err := NewFileStreaming(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Destroy()
+	if err = st.Write("test1"); err != nil {
+		t.Fatal(err)
+	}
+	// the record is readable before the stream is closed
+	if v, err := st.Read(); err != nil || String(v) != "test1" {
+		t.Errorf("unexpected record: %v, %v", String(v), err)
+	}
+	if err = st.Write("test2"); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if v, err := st.Read(); err != nil || String(v) != "test2" {
+		t.Errorf("unexpected record: %v, %v", String(v), err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "test1\ntest2\n" {
+		t.Errorf("unexpected content: %q", b)
+	}
+}
+
+func TestFileOutputAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.txt")
+	out, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default serializer writes each record as it is
+	if err = out.Write("test1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if IsFileExists(path) {
+		t.Errorf("%v exists before Close", path)
+	}
+	if err = out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "test1\n" {
+		t.Errorf("unexpected content: %q, %v", b, err)
+	}
+	if v, err := out.Read(); err != nil || String(v) != "test1" {
+		t.Errorf("unexpected record: %v, %v", String(v), err)
+	}
+	// with LineFraming, each record is framed even if it ends with a newline
+	framedPath := filepath.Join(t.TempDir(), "framed.txt")
+	framed, err := NewFileOutput(framedPath, nil, WithFraming(LineFraming))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"test1", "test2\n"} {
+		if err = framed.Write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = framed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(framedPath); err != nil || string(b) != "test1\ntest2\n\n" {
+		t.Errorf("unexpected content: %q, %v", b, err)
+	}
+
+	failed, err := NewFileOutput(filepath.Join(dir, "failed.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = failed.Write("test1"); err != nil {
+		t.Fatal(err)
+	}
+	failed.Destroy()
+	// a late write after Destroy doesn't leave a temporary file
+	if err = failed.Write("test2"); !errors.Is(err, ErrDestroyedOutput) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = failed.Close(); !errors.Is(err, ErrDestroyedOutput) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err = failed.Recreate(); err != nil {
+		t.Fatal(err)
+	}
+	if err = failed.Write("test3"); err != nil {
+		t.Fatal(err)
+	}
+	failed.Destroy()
+	// the file which is not written by the output is kept
+	skipped, err := NewFileOutput(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped.Destroy()
+	// the temporary file is created on the first write
+	if _, err = NewFileOutput(filepath.Join(dir, "unused.txt"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// the temporary file is removed if it cannot be renamed
+	blocked, err := NewFileOutput(filepath.Join(dir, "blocked"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blocked.Write("test1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "blocked", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = blocked.Close(); err == nil {
+		t.Error("expected a rename error")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "blocked" || entries[1].Name() != "records.txt" {
+		t.Errorf("unexpected files: %v", entries)
+	}
+}
+
+func TestBlobOutput(t *testing.T) {
+	for _, store := range []BlobStore{NewMemoryBlobStore(), NewDirBlobStore(t.TempDir())} {
+		out, err := NewBlobOutput(store, "dir/records.txt.gz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = out.Write("test1"); err != nil {
+			t.Fatal(err)
+		}
+		if keys, _ := store.List(context.Background(), "dir/"); len(keys) != 0 {
+			t.Errorf("uncommitted blob is listed: %v", keys)
+		}
+		if err = out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := out.Read(); err != nil || String(v) != "test1" {
+			t.Errorf("unexpected record: %v, %v", String(v), err)
+		}
+		if keys, _ := store.List(context.Background(), "dir/"); len(keys) != 1 || keys[0] != "dir/records.txt.gz" {
+			t.Errorf("unexpected keys: %v", keys)
+		}
+
+		again, err := NewBlobOutput(store, "dir/records.txt.gz", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !again.IsSkip() {
+			t.Errorf("%v is not skipped", again)
+		}
+		// the blob which is not written by the output is kept
+		again.Destroy()
+		if ok, _ := store.Exists(context.Background(), "dir/records.txt.gz"); !ok {
+			t.Errorf("%v is destroyed", again)
+		}
+		// it is deleted when the output is recreated to be written again, such as by ForceTasks
+		if err = again.Recreate(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := store.Exists(context.Background(), "dir/records.txt.gz"); ok {
+			t.Errorf("%v is not deleted", again)
+		}
+		if err = again.Close(); err != nil {
+			t.Fatal(err)
+		}
+		again.Destroy()
+		if ok, _ := store.Exists(context.Background(), "dir/records.txt.gz"); ok {
+			t.Errorf("%v is not destroyed", again)
+		}
+	}
+
+	// a failed task destroys only the blobs which it has written
+	store := NewMemoryBlobStore()
+	old, err := NewBlobOutput(store, "old.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = old.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var outs []Output
+	for _, key := range []string{"old.txt", "new.txt"} {
+		out, err := NewBlobOutput(store, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, out)
+	}
+	failed := NewTask("failed", WithOutputs(outs...), WithProcessor(func(tk Task) error {
+		tk.Out(1).Write("test1")
+		return errors.New("failed")
+	}))
+	if _, err := Run(failed); err == nil {
+		t.Fatal("expected an error")
+	}
+	if keys, _ := store.List(context.Background(), ""); len(keys) != 1 || keys[0] != "old.txt" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	// a late write after Destroy doesn't create the blob again
+	if err = outs[1].Write("test2"); !errors.Is(err, ErrDestroyedOutput) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the blob is created on the first write, so an output which is never written leaves no temporary file
+	dir := t.TempDir()
+	if _, err = NewBlobOutput(NewDirBlobStore(dir), "sub/child.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("unexpected file: %v", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pipeBlobStore returns the reader of a pipe from Open, so that a test can write the blob while it is read
+type pipeBlobStore struct {
+	*MemoryBlobStore
+	r *io.PipeReader
+}
+
+func (s *pipeBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.r, nil
+}
+
+func TestBlobOutputStreaming(t *testing.T) {
+	r, w := io.Pipe()
+	out, err := NewBlobOutput(&pipeBlobStore{MemoryBlobStore: NewMemoryBlobStore(), r: r}, "records.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := out.Channel()
+	// each record is sent as soon as it is read
+	go w.Write([]byte("test1\ntes"))
+	if v := <-ch; String(v) != "test1" {
+		t.Errorf("unexpected record: %v", String(v))
+	}
+	// the last record may not be terminated
+	go func() {
+		w.Write([]byte("t2"))
+		w.Close()
+	}()
+	if v := <-ch; String(v) != "test2" {
+		t.Errorf("unexpected record: %v", String(v))
+	}
+	if _, ok := <-ch; ok || out.Err() != nil {
+		t.Errorf("unexpected end of the records: %v, %v", ok, out.Err())
+	}
+
+	// a truncated length-prefixed record is reported by Err
+	r, w = io.Pipe()
+	out, err = NewBlobOutput(&pipeBlobStore{MemoryBlobStore: NewMemoryBlobStore(), r: r}, "records.bin", nil, WithFraming(LengthPrefixFraming))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch = out.Channel()
+	go func() {
+		b := LengthPrefixFraming.Frame([]byte("test1"))
+		b = append(b, LengthPrefixFraming.Frame([]byte("test2"))...)
+		w.Write(b[:len(b)-1])
+		w.Close()
+	}()
+	if v := <-ch; String(v) != "test1" {
+		t.Errorf("unexpected record: %v", String(v))
+	}
+	if _, ok := <-ch; ok || !errors.Is(out.Err(), io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected end of the records: %v, %v", ok, out.Err())
+	}
+	if _, err := out.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestInputError(t *testing.T) {
+	store := NewMemoryBlobStore()
+	bw, err := store.Create(context.Background(), "broken.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := LengthPrefixFraming.Frame([]byte("test1"))
+	if _, err = bw.Write(b[:len(b)-1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewBlobOutput(store, "broken.bin", nil, WithFraming(LengthPrefixFraming))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := NewTask("input", WithOutputs(out), WithProcessor(func(tk Task) error { return nil }))
+	last := NewTask("output", WithInputs(in.Out()), WithProcessor(func(tk Task) error {
+		for range tk.In().Channel() {
+		}
+		return nil
+	}))
+	// the reader stops at the truncated record, and the task fails with the error of the input
+	rs, err := Run(last)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report := rs.Task("output"); report.State != TaskFailed {
+		t.Errorf("unexpected report: %#v", report)
+	}
+}
+
+// fakeS3 is an S3 client which records the requests of the multipart uploads
+type fakeS3 struct {
+	s3iface.S3API
+	mu        sync.Mutex
+	parts     int
+	completed bool
+	aborted   bool
+}
+
+func (c *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, in *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (c *fakeS3) UploadPartWithContext(ctx aws.Context, in *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parts++
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprint(aws.Int64Value(in.PartNumber)))}, nil
+}
+
+func (c *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, in *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.completed = true
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, in *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	// a real request fails on a canceled context
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (c *fakeS3) uploadedParts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.parts
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	newStore := func(c *fakeS3) *S3BlobStore {
+		return &S3BlobStore{
+			Client:          c,
+			Uploader:        s3manager.NewUploaderWithClient(c),
+			Bucket:          "bucket",
+			MultipartUpload: true,
+			PartSize:        s3manager.MinUploadPartSize,
+		}
+	}
+	part := bytes.Repeat([]byte("a"), int(s3manager.MinUploadPartSize))
+
+	c := &fakeS3{}
+	bw, err := newStore(c).Create(context.Background(), "records.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := bw.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.parts != 2 || !c.completed || c.aborted {
+		t.Errorf("unexpected upload: %+v", c)
+	}
+
+	// the uploaded parts are removed on Abort
+	c = &fakeS3{}
+	bw, err = newStore(c).Create(context.Background(), "records.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Write(part); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.uploadedParts() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first part is not uploaded")
+		}
+	}
+	if err := bw.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if c.completed || !c.aborted {
+		t.Errorf("unexpected upload: %+v", c)
+	}
+}
@@ -0,0 +1,109 @@
+package flow
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Plan describes what a flow would do without running it
+type Plan struct {
+	// Tasks are sorted in dependency order
+	Tasks []*PlannedTask
+}
+
+// PlannedTask describes whether a task would run or be skipped, and why
+type PlannedTask struct {
+	Name    string
+	Skip    bool
+	Reason  string
+	Outputs []*PlannedOutput
+}
+
+// PlannedOutput describes an output of a planned task
+type PlannedOutput struct {
+	Name string
+	// Location is the path or the key of the output, or empty if the output has no location
+	Location string
+	// Exists is true if the output already exists, so it will not be written
+	Exists bool
+}
+
+// String returns the plan in a human readable form
+func (pl *Plan) String() string {
+	var buf bytes.Buffer
+	for _, pt := range pl.Tasks {
+		action := "run"
+		if pt.Skip {
+			action = "skip"
+		}
+		fmt.Fprintf(&buf, "%v\t%v\t(%v)\n", action, pt.Name, pt.Reason)
+		for _, po := range pt.Outputs {
+			state := "missing"
+			if po.Exists {
+				state = "exists"
+			}
+			fmt.Fprintf(&buf, "\t%v\t%v\n", state, po.Location)
+		}
+	}
+	return buf.String()
+}
+
+// Plan returns an execution plan which tells whether each task would run or be skipped.
+// It accepts the same options as Run, and it does not start or force any task.
+func (fl *Flow) Plan(opts ...FlowOptions) (*Plan, error) {
+	if err := fl.Validate(); err != nil {
+		return nil, err
+	}
+	forced, err := fl.forcedTasks(fl.options(opts))
+	if err != nil {
+		return nil, err
+	}
+	isForced := map[*task]bool{}
+	for _, tk := range forced {
+		isForced[tk] = true
+	}
+	pl := new(Plan)
+	for _, tk := range sortTasks(fl.entry.(*task)) {
+		pl.Tasks = append(pl.Tasks, planTask(tk, isForced[tk]))
+	}
+	return pl, nil
+}
+
+func planTask(tk *task, forced bool) *PlannedTask {
+	pt := &PlannedTask{
+		Name: tk.Name(),
+		Skip: tk.isSkip() && !forced,
+	}
+	var missing *PlannedOutput
+	for _, out := range tk.outputs {
+		po := &PlannedOutput{
+			Name:     out.String(),
+			Location: outputLocation(out),
+			Exists:   out.IsSkip(),
+		}
+		if !po.Exists && missing == nil {
+			missing = po
+		}
+		pt.Outputs = append(pt.Outputs, po)
+	}
+	switch {
+	case forced:
+		pt.Reason = "task is forced"
+	case len(tk.outputs) == 0:
+		pt.Reason = "task has no output"
+	case pt.Skip:
+		pt.Reason = "all outputs already exist"
+	case missing.Location != "":
+		pt.Reason = fmt.Sprintf("%v does not exist", missing.Location)
+	default:
+		pt.Reason = fmt.Sprintf("%v is always written", missing.Name)
+	}
+	return pt
+}
+
+func outputLocation(out Output) string {
+	if l, ok := unwrapOutput(out).(Locator); ok {
+		return l.Location()
+	}
+	return ""
+}
@@ -0,0 +1,328 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// resourcePool is a weighted semaphore which serves the waiters in FIFO order
+type resourcePool struct {
+	name     string
+	capacity int
+
+	mu      sync.Mutex
+	used    int
+	waiters []*poolWaiter
+}
+
+type poolWaiter struct {
+	weight int
+	ready  chan struct{}
+}
+
+func newResourcePool(name string, capacity int) *resourcePool {
+	return &resourcePool{
+		name:     name,
+		capacity: capacity,
+	}
+}
+
+// acquire blocks until weight is available or ctx is done
+func (p *resourcePool) acquire(ctx context.Context, weight int) error {
+	p.mu.Lock()
+	if len(p.waiters) == 0 && p.used+weight <= p.capacity {
+		p.used += weight
+		p.mu.Unlock()
+		return nil
+	}
+	w := &poolWaiter{weight: weight, ready: make(chan struct{})}
+	p.waiters = append(p.waiters, w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		select {
+		case <-w.ready:
+			// acquired while being canceled
+			p.used -= weight
+			p.notify()
+		default:
+			for i, other := range p.waiters {
+				if other == w {
+					p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+					break
+				}
+			}
+			p.notify()
+		}
+		return context.Cause(ctx)
+	}
+}
+
+func (p *resourcePool) release(weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.used -= weight
+	p.notify()
+}
+
+// notify wakes the waiters from the head of the queue as long as capacity remains
+func (p *resourcePool) notify() {
+	for len(p.waiters) > 0 {
+		w := p.waiters[0]
+		if p.used+w.weight > p.capacity {
+			return
+		}
+		p.used += w.weight
+		p.waiters = p.waiters[1:]
+		close(w.ready)
+	}
+}
+
+// concurrencyPool is the name of the pool which limits the number of running tasks
+const concurrencyPool = ""
+
+type resourceRequest struct {
+	pool   *resourcePool
+	weight int
+}
+
+// newResourcePools returns the pools which are configured by the flow options
+func newResourcePools(op *flowOptions) map[string]*resourcePool {
+	pools := map[string]*resourcePool{}
+	if op.MaxConcurrency > 0 {
+		pools[concurrencyPool] = newResourcePool("concurrency", op.MaxConcurrency)
+	}
+	for name, capacity := range op.ResourcePools {
+		pools[name] = newResourcePool(name, capacity)
+	}
+	return pools
+}
+
+// resourceGroup is a set of tasks connected by streaming outputs such as ChannelOutput.
+// They must run at the same time, so the group acquires the resources of all its tasks at once
+// when all of them are ready, and releases them when all of them finish.
+type resourceGroup struct {
+	ctx   context.Context
+	tasks []*task
+	reqs  []*resourceRequest
+
+	mu       sync.Mutex
+	arrived  int // tasks which are ready or never start
+	running  int // ready tasks which have not finished
+	acquired bool
+	err      error
+	started  chan struct{}
+}
+
+func (g *resourceGroup) String() string {
+	names := make([]string, len(g.tasks))
+	for i, tk := range g.tasks {
+		names[i] = fmt.Sprintf("'%v'", tk.Name())
+	}
+	return fmt.Sprintf("tasks %v connected by streaming outputs", strings.Join(names, ", "))
+}
+
+// wait blocks until all tasks of the group are ready and the resources are acquired.
+// The task must call release when it finishes, even if wait fails.
+func (g *resourceGroup) wait(ctx context.Context) error {
+	g.mu.Lock()
+	g.running++
+	g.mu.Unlock()
+	g.arrive()
+	select {
+	case <-g.started:
+		return g.err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// leave is called by a task which never starts, so that the other tasks of the group don't wait for it
+func (g *resourceGroup) leave() {
+	g.arrive()
+}
+
+// arrive acquires the resources in the background when all tasks of the group have arrived
+func (g *resourceGroup) arrive() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.arrived++
+	if g.arrived < len(g.tasks) {
+		return
+	}
+	if g.running == 0 {
+		close(g.started)
+		return
+	}
+	go g.acquire()
+}
+
+func (g *resourceGroup) acquire() {
+	err := acquireResources(g.ctx, g.reqs)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.err = err
+	g.acquired = err == nil
+	close(g.started)
+	g.releaseIfDone()
+}
+
+func (g *resourceGroup) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.running--
+	g.releaseIfDone()
+}
+
+func (g *resourceGroup) releaseIfDone() {
+	if g.acquired && g.running == 0 {
+		releaseResources(g.reqs)
+		g.acquired = false
+	}
+}
+
+// checkResources fails if tk requires an unknown pool, or more than the capacity of a pool
+func checkResources(pools map[string]*resourcePool, tk *task) error {
+	for name, weight := range tk.resources {
+		pool, ok := pools[name]
+		if !ok {
+			return fmt.Errorf("task '%v' requires unknown resource pool '%v'", tk.Name(), name)
+		}
+		if weight > pool.capacity {
+			return fmt.Errorf("task '%v' requires %v of resource pool '%v' whose capacity is %v", tk.Name(), weight, name, pool.capacity)
+		}
+	}
+	return nil
+}
+
+// resourceGroups groups the tasks connected by streaming outputs, and returns the group of each task which requires resources.
+// The forced tasks are not skipped, even though their outputs still exist.
+// The requests of a group are sorted by pool name so that groups acquiring multiple pools never deadlock each other.
+// It fails if a group requires more than the capacity of a pool in total,
+// or a task of a group waits for an output of another task of the group which is not streamed, such as FileOutput.
+func resourceGroups(ctx context.Context, pools map[string]*resourcePool, tasks []*task, forced map[*task]bool) (map[*task]*resourceGroup, error) {
+	skipped := func(tk *task) bool {
+		return tk.isSkip() && !forced[tk]
+	}
+	// union-find over the streaming edges, whose outputs are ready before their tasks run
+	roots := map[*task]*task{}
+	var find func(tk *task) *task
+	find = func(tk *task) *task {
+		if r, ok := roots[tk]; ok && r != tk {
+			r = find(r)
+			roots[tk] = r
+			return r
+		}
+		return tk
+	}
+	type edge struct {
+		tk *task
+		in *taskInput
+	}
+	var waits []edge // the edges which are not streamed
+	for _, tk := range tasks {
+		for _, in := range tk.inputs {
+			for _, dep := range resolveDependentInputs(in) {
+				ti := dep.(*taskInput)
+				if skipped(ti.tk) {
+					continue
+				}
+				if !isClosed(ti.Ready()) {
+					waits = append(waits, edge{tk: tk, in: ti})
+					continue
+				}
+				if a, b := find(tk), find(ti.tk); a != b {
+					roots[a] = b
+				}
+			}
+		}
+	}
+	groups := map[*task]*resourceGroup{}
+	var ordered []*resourceGroup
+	for _, tk := range tasks {
+		if skipped(tk) {
+			continue
+		}
+		root := find(tk)
+		g, ok := groups[root]
+		if !ok {
+			g = &resourceGroup{ctx: ctx, started: make(chan struct{})}
+			groups[root] = g
+			ordered = append(ordered, g)
+		}
+		g.tasks = append(g.tasks, tk)
+	}
+	byTask := map[*task]*resourceGroup{}
+	for _, g := range ordered {
+		weights := map[string]int{}
+		if _, ok := pools[concurrencyPool]; ok {
+			weights[concurrencyPool] = len(g.tasks)
+		}
+		for _, tk := range g.tasks {
+			for name, weight := range tk.resources {
+				weights[name] += weight
+			}
+		}
+		if len(weights) == 0 {
+			continue
+		}
+		// the group cannot start at once if a task of it waits for another one to finish
+		for _, w := range waits {
+			if groups[find(w.tk)] == g && groups[find(w.in.tk)] == g {
+				return nil, fmt.Errorf("%v must run at the same time, but task '%v' waits for %v of task '%v'", g, w.tk.Name(), w.in.String(), w.in.tk.Name())
+			}
+		}
+		var names []string
+		for name := range weights {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pool := pools[name]
+			if weights[name] > pool.capacity {
+				if name == concurrencyPool {
+					return nil, fmt.Errorf("%v must run at the same time, but the max concurrency is %v", g, pool.capacity)
+				}
+				return nil, fmt.Errorf("%v require %v of resource pool '%v' whose capacity is %v in total", g, weights[name], name, pool.capacity)
+			}
+			g.reqs = append(g.reqs, &resourceRequest{pool: pool, weight: weights[name]})
+		}
+		for _, tk := range g.tasks {
+			byTask[tk] = g
+		}
+	}
+	return byTask, nil
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func acquireResources(ctx context.Context, reqs []*resourceRequest) error {
+	for i, req := range reqs {
+		if err := req.pool.acquire(ctx, req.weight); err != nil {
+			releaseResources(reqs[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func releaseResources(reqs []*resourceRequest) {
+	for _, req := range reqs {
+		req.pool.release(req.weight)
+	}
+}
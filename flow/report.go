@@ -0,0 +1,155 @@
+package flow
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// TaskState is the final state of a task in a flow
+type TaskState int
+
+const (
+	// TaskPending means the task has not finished
+	TaskPending TaskState = iota
+	// TaskSucceeded means the processor of the task returned without error
+	TaskSucceeded
+	// TaskFailed means the task returned an error, panicked or timed out
+	TaskFailed
+	// TaskSkipped means all outputs of the task already existed
+	TaskSkipped
+	// TaskCanceled means the flow was canceled before the task finished
+	TaskCanceled
+	// TaskUpstreamFailed means the task was never started because a task on which it depends failed
+	TaskUpstreamFailed
+)
+
+var taskStateNames = map[TaskState]string{
+	TaskPending:   "pending",
+	TaskSucceeded: "succeeded",
+	TaskFailed:    "failed",
+	TaskSkipped:   "skipped",
+	TaskCanceled:  "canceled",
+
+	TaskUpstreamFailed: "upstream_failed",
+}
+
+func (st TaskState) String() string {
+	return taskStateNames[st]
+}
+
+func (st TaskState) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// TaskReport is a summary of a task in a flow
+type TaskReport struct {
+	Name      string
+	State     TaskState
+	StartTime time.Time
+	EndTime   time.Time
+	Elapsed   time.Duration
+	Workers   int
+	Attempts  int
+	Error     error
+	Outputs   []*OutputReport
+}
+
+// OutputReport holds the number of items written to an output
+type OutputReport struct {
+	Name  string
+	Count int64
+}
+
+func (tr *TaskReport) MarshalJSON() ([]byte, error) {
+	type report TaskReport
+	var errString string
+	if tr.Error != nil {
+		errString = tr.Error.Error()
+	}
+	return json.Marshal(&struct {
+		*report
+		Elapsed string
+		Error   string `json:",omitempty"`
+	}{
+		report:  (*report)(tr),
+		Elapsed: tr.Elapsed.String(),
+		Error:   errString,
+	})
+}
+
+func newTaskReport(tk *task) *TaskReport {
+	return &TaskReport{
+		Name:    tk.Name(),
+		Workers: tk.workerNumber,
+	}
+}
+
+// Tasks returns the reports of all tasks in dependency order
+func (rs *Result) Tasks() []*TaskReport {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	reports := make([]*TaskReport, len(rs.tasks))
+	for i, tk := range rs.tasks {
+		r := *rs.reports[tk]
+		reports[i] = &r
+	}
+	return reports
+}
+
+// UpstreamFailed returns the names of the tasks which were never started because an upstream task failed
+func (rs *Result) UpstreamFailed() []string {
+	var names []string
+	for _, r := range rs.Tasks() {
+		if r.State == TaskUpstreamFailed {
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+// Task returns the report of the task which has the specified name, or nil if no such task exists
+func (rs *Result) Task(name string) *TaskReport {
+	for _, r := range rs.Tasks() {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rs *Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Tasks []*TaskReport
+	}{
+		Tasks: rs.Tasks(),
+	})
+}
+
+func (rs *Result) setStarted(tk *task) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.reports[tk].StartTime = time.Now()
+}
+
+func (rs *Result) setFinished(tk *task, state TaskState) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r := rs.reports[tk]
+	r.State = state
+	r.EndTime = time.Now()
+	if !r.StartTime.IsZero() {
+		r.Elapsed = r.EndTime.Sub(r.StartTime)
+	}
+	r.Attempts = tk.attemptCount()
+	if err := tk.err(); err != nil {
+		r.Error = err
+	}
+	r.Outputs = nil
+	for _, out := range tk.outputs {
+		r.Outputs = append(r.Outputs, &OutputReport{
+			Name:  out.String(),
+			Count: atomic.LoadInt64(&out.(*taskInput).written),
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// JSONLinesSerializer serializes each value into a line of JSON.
+// Each line is deserialized into an interface{} value as encoding/json does.
+var JSONLinesSerializer = &Serializer{
+	Serialize: json.Marshal,
+	Deserialize: func(b []byte) (interface{}, error) {
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	},
+}
+
+// NewJSONLinesSerializer returns a serializer which serializes each value into a line of JSON,
+// and deserializes each line into a value of T.
+func NewJSONLinesSerializer[T any]() *Serializer {
+	return &Serializer{
+		Serialize: json.Marshal,
+		Deserialize: func(b []byte) (interface{}, error) {
+			var v T
+			if err := json.Unmarshal(b, &v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		},
+	}
+}
+
+// GobSerializer serializes each value by encoding/gob, and delimits the records by LengthPrefixFraming,
+// so any value including binary data round-trips.
+// The concrete types other than the basic ones must be registered by gob.Register.
+var GobSerializer = &Serializer{
+	Serialize: func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	Deserialize: func(b []byte) (interface{}, error) {
+		var v interface{}
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	},
+	recordFraming: LengthPrefixFraming,
+}
+
+// NewGobSerializer returns a serializer like GobSerializer which serializes values of T,
+// and deserializes each record into a value of T. T need not be registered.
+func NewGobSerializer[T any]() *Serializer {
+	return &Serializer{
+		Serialize: func(iv interface{}) ([]byte, error) {
+			v, ok := iv.(T)
+			if !ok {
+				return nil, ErrSerializeValue
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		Deserialize: func(b []byte) (interface{}, error) {
+			var v T
+			if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		},
+		recordFraming: LengthPrefixFraming,
+	}
+}
+
+// NewCSVSerializer returns a serializer which serializes each value into a CSV record.
+// Values must be []string, or map[string]string if columns are given.
+//
+// If columns are given, they are written as the header row of each file,
+// and each record is deserialized into a map[string]string keyed by the header row of the file.
+// Otherwise each record is deserialized into a []string.
+// Quoted fields may contain newlines.
+func NewCSVSerializer(columns ...string) *Serializer {
+	return newDelimitedSerializer(',', columns)
+}
+
+// NewTSVSerializer is like NewCSVSerializer but separates the fields by tabs
+func NewTSVSerializer(columns ...string) *Serializer {
+	return newDelimitedSerializer('\t', columns)
+}
+
+func newDelimitedSerializer(comma rune, columns []string) *Serializer {
+	srz := &Serializer{
+		Serialize: func(iv interface{}) ([]byte, error) {
+			switch v := iv.(type) {
+			case []string:
+				return encodeRecord(comma, v)
+			case map[string]string:
+				if len(columns) == 0 {
+					return nil, ErrSerializeValue
+				}
+				record := make([]string, len(columns))
+				for i, col := range columns {
+					record[i] = v[col]
+				}
+				return encodeRecord(comma, record)
+			default:
+				return nil, ErrSerializeValue
+			}
+		},
+		Deserialize: func(b []byte) (interface{}, error) {
+			return decodeRecord(comma, b)
+		},
+		recordFraming: csvFraming{},
+	}
+	if len(columns) == 0 {
+		return srz
+	}
+	header, err := encodeRecord(comma, columns)
+	if err != nil {
+		panic(err)
+	}
+	srz.Header = header
+	srz.Deserialize = recordMapper(comma, columns)
+	srz.DeserializeHeader = func(b []byte) (DeserializeFunc, error) {
+		cols, err := decodeRecord(comma, b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header: %w", err)
+		}
+		return recordMapper(comma, cols), nil
+	}
+	return srz
+}
+
+// recordMapper returns a DeserializeFunc which maps each field to the column at the same position
+func recordMapper(comma rune, columns []string) DeserializeFunc {
+	return func(b []byte) (interface{}, error) {
+		record, err := decodeRecord(comma, b)
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != len(columns) {
+			return nil, fmt.Errorf("wrong number of fields: %v != %v", len(record), len(columns))
+		}
+		m := make(map[string]string, len(columns))
+		for i, col := range columns {
+			m[col] = record[i]
+		}
+		return m, nil
+	}
+}
+
+func encodeRecord(comma rune, record []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Comma = comma
+	if err := w.Write(record); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+func decodeRecord(comma rune, b []byte) ([]string, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	return r.Read()
+}
+
+// csvFraming terminates each record by a newline.
+// Unlike LineFraming, newlines in quoted fields don't terminate the record, and blank lines are skipped.
+type csvFraming struct{}
+
+func (csvFraming) Frame(record []byte) []byte {
+	return LineFraming.Frame(record)
+}
+
+func (csvFraming) Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	quoted := false
+	for i, c := range data {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case '\n':
+			if quoted {
+				continue
+			}
+			token = bytes.TrimSuffix(data[:i], []byte{'\r'})
+			if len(token) == 0 {
+				// skip blank lines
+				return i + 1, nil, nil
+			}
+			return i + 1, token, nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
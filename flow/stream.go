@@ -0,0 +1,333 @@
+package flow
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ItemProcessor processes a value read from the first input of a task, and writes the results to the outputs of tk
+type ItemProcessor func(ctx context.Context, tk Task, v interface{}) error
+
+// WithItemProcessor sets a processor which is called for each value of the first input of the task
+// by the workers set by WithWorker, instead of reading the input by itself.
+// With WithOrder, the values written for each input value reach the outputs in the order of the input.
+func WithItemProcessor(processor ItemProcessor) Options {
+	return func(opts *options) {
+		opts.ItemProcessor = processor
+	}
+}
+
+// WithOrder makes the workers of a task with an item processor write the values in the order of the input.
+// The workers still process the values in parallel. Each input value is tagged with a sequence number,
+// and the values written for it are held in a reorder buffer until all preceding values are written.
+// The buffer holds up to twice the number of workers input values unless the size is set by WithOrderedWorker.
+// It bounds the input values, not the values written for them, so all values written for an input value,
+// such as the results of FlatMap, are held in memory until the preceding values are written.
+// A task with a processor set by WithProcessor reads the input by itself, so it keeps the order only with one worker,
+// and Flow.Validate fails if it has WithOrder and multiple workers.
+func WithOrder() Options {
+	return func(opts *options) {
+		opts.Ordered = true
+	}
+}
+
+// WithOrderedWorker runs workerNumber workers in the order-preserving mode of WithOrder,
+// with a reorder buffer which holds up to bufferSize input values.
+// When the buffer is full, the workers wait for the slowest value before reading the next one.
+func WithOrderedWorker(workerNumber, bufferSize int) Options {
+	return func(opts *options) {
+		WithWorker(workerNumber)(opts)
+		if bufferSize < opts.WorkerNumber {
+			bufferSize = opts.WorkerNumber
+		}
+		opts.Ordered = true
+		opts.ReorderBufferSize = bufferSize
+	}
+}
+
+// streamTask returns a task which reads ins with the processor.
+// If opts has no output, the task writes to a new ChannelOutput named name.
+func streamTask(name string, ins []Input, processor Options, opts []Options) Task {
+	op := defaultOptions()
+	for _, opt := range opts {
+		opt(op)
+	}
+	base := []Options{WithInputs(ins...)}
+	if len(op.Outputs) == 0 {
+		base = append(base, WithOutputs(NewChannelOutput(name, make(chan interface{}))))
+	}
+	return NewTask(name, append(append(base, opts...), processor)...)
+}
+
+// Map returns a task which writes fn(v) for each value v read from in.
+// The values are written to all outputs passed by WithOutputs, or to a new ChannelOutput which is read through Out of the task.
+// It can be configured by the options of NewTask, such as WithWorker and WithOrder.
+func Map(name string, in Input, fn func(interface{}) (interface{}, error), opts ...Options) Task {
+	return streamTask(name, []Input{in}, WithItemProcessor(func(_ context.Context, tk Task, v interface{}) error {
+		r, err := fn(v)
+		if err != nil {
+			return err
+		}
+		return writeAll(tk, r)
+	}), opts)
+}
+
+// Filter returns a task which writes the values read from in for which fn returns true, like Map
+func Filter(name string, in Input, fn func(interface{}) (bool, error), opts ...Options) Task {
+	return streamTask(name, []Input{in}, WithItemProcessor(func(_ context.Context, tk Task, v interface{}) error {
+		ok, err := fn(v)
+		if err != nil || !ok {
+			return err
+		}
+		return writeAll(tk, v)
+	}), opts)
+}
+
+// FlatMap returns a task which writes all values returned by fn for each value read from in, like Map
+func FlatMap(name string, in Input, fn func(interface{}) ([]interface{}, error), opts ...Options) Task {
+	return streamTask(name, []Input{in}, WithItemProcessor(func(_ context.Context, tk Task, v interface{}) error {
+		rs, err := fn(v)
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if err := writeAll(tk, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), opts)
+}
+
+// Batch returns a task which writes the values read from in as []interface{} of up to size values, like Map.
+// A batch is written when it has size values, or maxWait after its first value is read if maxWait is positive.
+// Each worker forms its own batches, so the batches keep the order of the input only with one worker, the default.
+// Like a task with WithProcessor, Flow.Validate fails if it has WithOrder and multiple workers.
+func Batch(name string, in Input, size int, maxWait time.Duration, opts ...Options) Task {
+	if size <= 0 {
+		size = 1
+	}
+	return streamTask(name, []Input{in}, WithProcessorContext(func(ctx context.Context, tk Task) error {
+		ch := tk.In().Channel()
+		var (
+			batch   []interface{}
+			timer   *time.Timer
+			expired <-chan time.Time
+		)
+		flush := func() error {
+			if timer != nil {
+				timer.Stop()
+				timer, expired = nil, nil
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			b := batch
+			batch = nil
+			return writeAll(tk, b)
+		}
+		for {
+			select {
+			case v, ok := <-ch:
+				if !ok {
+					return flush()
+				}
+				batch = append(batch, v)
+				if len(batch) >= size {
+					if err := flush(); err != nil {
+						return err
+					}
+				} else if len(batch) == 1 && maxWait > 0 {
+					timer = time.NewTimer(maxWait)
+					expired = timer.C
+				}
+			case <-expired:
+				if err := flush(); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+	}), opts)
+}
+
+// writeAll writes v to all outputs of tk
+func writeAll(tk Task, v interface{}) error {
+	for i := range tk.outputList() {
+		if err := tk.Out(i).Write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// itemProcessor returns the processor of the workers of an attempt, which calls the item function for each value of the first input
+func (tk *task) itemProcessor() func(context.Context, Task) error {
+	if !tk.ordered {
+		return func(ctx context.Context, _ Task) error {
+			ch := tk.In().Channel()
+			for {
+				select {
+				case v, ok := <-ch:
+					if !ok {
+						return nil
+					}
+					if err := tk.item(ctx, tk, v); err != nil {
+						return err
+					}
+				case <-ctx.Done():
+					return context.Cause(ctx)
+				}
+			}
+		}
+	}
+	size := tk.reorderBufferSize
+	if size <= 0 {
+		size = 2 * tk.workerNumber
+	}
+	rb := newReorderBuffer(tk, size)
+	return func(ctx context.Context, _ Task) error {
+		for {
+			seq, v, ok, err := rb.read(ctx)
+			if err != nil || !ok {
+				return err
+			}
+			it := &itemTask{Task: tk}
+			err = callItem(ctx, tk.item, it, v)
+			if err == nil {
+				err = rb.put(seq, it.writes)
+			}
+			if err != nil {
+				rb.fail()
+				return err
+			}
+		}
+	}
+}
+
+// callItem calls fn with v, and returns a PanicError if fn panics, so that the other workers are stopped
+func callItem(ctx context.Context, fn ItemProcessor, tk Task, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+	}()
+	return fn(ctx, tk, v)
+}
+
+// itemTask is the view of a task passed to an ordered item processor, which holds the values written for an input value
+type itemTask struct {
+	Task
+	mu     sync.Mutex
+	writes []itemWrite
+}
+
+var _ Task = (*itemTask)(nil)
+
+type itemWrite struct {
+	out Output
+	v   interface{}
+}
+
+func (it *itemTask) Out(idx ...int) Output {
+	return &itemOutput{Output: it.Task.Out(idx...), it: it}
+}
+
+// itemOutput holds the written values in the itemTask
+type itemOutput struct {
+	Output
+	it *itemTask
+}
+
+func (out *itemOutput) Write(v interface{}) error {
+	out.it.mu.Lock()
+	defer out.it.mu.Unlock()
+	out.it.writes = append(out.it.writes, itemWrite{out: out.Output, v: v})
+	return nil
+}
+
+// reorderBuffer tags the values read by the workers with sequence numbers,
+// and writes the values written for them to the outputs in the order of the sequence numbers
+type reorderBuffer struct {
+	tk    *task
+	ch    chan interface{}
+	slots chan struct{} // bounds the values which are read but not written yet
+
+	failed   chan struct{}
+	failOnce sync.Once
+
+	readMu sync.Mutex
+	seq    uint64
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64][]itemWrite
+}
+
+func newReorderBuffer(tk *task, size int) *reorderBuffer {
+	return &reorderBuffer{
+		tk:      tk,
+		ch:      tk.In().Channel(),
+		slots:   make(chan struct{}, size),
+		failed:  make(chan struct{}),
+		pending: map[uint64][]itemWrite{},
+	}
+}
+
+// read returns the next value of the input and its sequence number.
+// It returns false when the input is closed or another worker failed.
+func (rb *reorderBuffer) read(ctx context.Context) (uint64, interface{}, bool, error) {
+	select {
+	case rb.slots <- struct{}{}:
+	case <-rb.failed:
+		return 0, nil, false, nil
+	case <-ctx.Done():
+		return 0, nil, false, context.Cause(ctx)
+	}
+	rb.readMu.Lock()
+	defer rb.readMu.Unlock()
+	select {
+	case v, ok := <-rb.ch:
+		if ok {
+			seq := rb.seq
+			rb.seq++
+			return seq, v, true, nil
+		}
+		<-rb.slots
+		return 0, nil, false, nil
+	case <-rb.failed:
+		return 0, nil, false, nil
+	case <-ctx.Done():
+		return 0, nil, false, context.Cause(ctx)
+	}
+}
+
+// put buffers the values written for seq, and writes the buffered values which are next in order
+func (rb *reorderBuffer) put(seq uint64, ws []itemWrite) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.pending[seq] = ws
+	for {
+		ws, ok := rb.pending[rb.next]
+		if !ok {
+			return nil
+		}
+		delete(rb.pending, rb.next)
+		rb.next++
+		<-rb.slots
+		for _, w := range ws {
+			if err := w.out.Write(w.v); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fail stops the other workers
+func (rb *reorderBuffer) fail() {
+	rb.failOnce.Do(func() {
+		close(rb.failed)
+	})
+}
@@ -1,6 +1,13 @@
 package flow
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type Task interface {
 	// Name returns task name
@@ -11,8 +18,14 @@ type Task interface {
 	Out(...int) Output
 	// Requres returns the task list on which this task depends
 	Requires() []Task
+	// Context returns the context of the running flow, which is done when the flow is canceled
+	Context() context.Context
 
-	init() error
+	// the inputs and outputs passed by WithInputs and WithOutputs
+	inputList() []Input
+	outputList() []Output
+
+	init(context.Context) chan struct{}
 	run() error
 	skip() error
 	isSkip() bool
@@ -22,33 +35,115 @@ type Task interface {
 
 	// this channel returns a value when all inputs is ready
 	ready() chan struct{}
+	wait() error
 	destroy()
+	cancel(error)
+
+	addError(error)
+	err() error
+	setContext(context.Context, context.CancelCauseFunc)
 }
 
 type task struct {
 	name string
 
-	processor func(Task) error
+	processor func(context.Context, Task) error
 	requires  []Task
+	parent    context.Context // context of the task in the flow
+	abort     context.CancelCauseFunc
+	ctx       context.Context // context of the current attempt
 
 	inputs  []Input
 	outputs []Output
 
 	workerNumber int
-	wg           sync.WaitGroup
+	timeout      time.Duration
+	resources    map[string]int
+
+	item              ItemProcessor // processes each value of the first input instead of processor
+	ordered           bool
+	reorderBufferSize int
+
+	hashJoin bool // reads all values of the second input before the first one
+
+	maxAttempts int
+	backoff     Backoff
+	attempts    int
+	settled     int // the last attempt which has returned
 
 	done bool
+
+	mu   sync.Mutex
+	errs []error
 }
 
-func (tk *task) init() error {
+// init starts the workers and returns a channel which is closed when all workers return
+func (tk *task) init(ctx context.Context) chan struct{} {
+	attempt := tk.attempts
+	process := tk.processor
+	if tk.item != nil {
+		process = tk.itemProcessor()
+	}
+	wg := new(sync.WaitGroup)
 	for i := 0; i < tk.workerNumber; i++ {
-		tk.wg.Add(1)
-		go func(wg *sync.WaitGroup) {
+		wg.Add(1)
+		ctx := context.WithValue(ctx, workerIndexKey{}, i)
+		go func() {
 			defer wg.Done()
-			tk.processor(tk)
-		}(&tk.wg)
+			defer func() {
+				if v := recover(); v != nil {
+					tk.addAttemptError(attempt, &PanicError{Value: v})
+				}
+			}()
+			if err := process(ctx, tk); err != nil {
+				tk.addAttemptError(attempt, err)
+			}
+		}()
 	}
-	return nil
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+type workerIndexKey struct{}
+
+// WorkerIndex returns the index of the worker, from 0 to the number of workers set by WithWorker,
+// which runs the processor receiving ctx.
+// The workers of one task can read separate inputs with it, such as the partitions of a PartitionedOutput.
+func WorkerIndex(ctx context.Context) int {
+	i, _ := ctx.Value(workerIndexKey{}).(int)
+	return i
+}
+
+func (tk *task) addError(err error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.errs = append(tk.errs, err)
+}
+
+// addAttemptError adds the error of a worker unless the worker outlived its attempt
+func (tk *task) addAttemptError(attempt int, err error) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if attempt <= tk.settled {
+		return
+	}
+	tk.errs = append(tk.errs, err)
+}
+
+// err returns a TaskError which holds all errors of this task, or nil if it has no error
+func (tk *task) err() error {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if len(tk.errs) == 0 {
+		return nil
+	}
+	errs := make([]error, len(tk.errs))
+	copy(errs, tk.errs)
+	return &TaskError{Name: tk.name, Errors: errs}
 }
 
 func (tk *task) In(idx ...int) Input {
@@ -71,6 +166,77 @@ func (tk *task) destroy() {
 	}
 }
 
+// rollback destroys the outputs and recreates them, and rewinds the inputs so that the task can be run again
+func (tk *task) rollback() error {
+	for _, out := range tk.outputs {
+		out.Destroy()
+		if err := unwrapOutput(out).(Recreator).Recreate(); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&out.(*taskInput).written, 0)
+	}
+	for _, in := range tk.inputs {
+		if err := unwrapOutput(in.(TaskInput)).(Rewinder).Rewind(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRetryable returns true if all outputs can be recreated and all inputs can be rewound.
+// An output which is already ready cannot be recreated because its readers may have read it.
+// It is the case of FileStreaming, which is a Recreator so that ForceTasks can rerun its task,
+// but is tailed by the readers while it is written.
+func (tk *task) isRetryable() bool {
+	for _, out := range tk.outputs {
+		if _, ok := unwrapOutput(out).(Recreator); !ok {
+			Logger.Printf("Task '%v' cannot be retried: %v is not a Recreator\n", tk.name, out.String())
+			return false
+		}
+		select {
+		case <-out.Ready():
+			Logger.Printf("Task '%v' cannot be retried: %v is streamed to the readers\n", tk.name, out.String())
+			return false
+		default:
+		}
+	}
+	for _, in := range tk.inputs {
+		if _, ok := unwrapOutput(in.(TaskInput)).(Rewinder); !ok {
+			Logger.Printf("Task '%v' cannot be retried: %v is not a Rewinder\n", tk.name, in.String())
+			return false
+		}
+	}
+	return true
+}
+
+// force destroys and recreates the outputs which already exist so that the task runs again
+func (tk *task) force() error {
+	for _, out := range tk.outputs {
+		if !out.IsSkip() {
+			continue
+		}
+		rc, ok := unwrapOutput(out).(Recreator)
+		if !ok {
+			return fmt.Errorf("task '%v' cannot be forced: %v is not a Recreator", tk.name, out.String())
+		}
+		Logger.Printf("Task '%v' is forced, destroy %v\n", tk.name, out.String())
+		out.Destroy()
+		if err := rc.Recreate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tk *task) cancel(err error) {
+	for _, in := range tk.inputs {
+		cancelOutput(in.(TaskInput), err)
+	}
+	for _, out := range tk.outputs {
+		cancelOutput(out, err)
+	}
+}
+
 func (tk *task) isSkip() bool {
 	if len(tk.outputs) == 0 {
 		return false
@@ -100,6 +266,49 @@ func (tk *task) ready() chan struct{} {
 	return ch
 }
 
+// wait blocks until all inputs are ready.
+// It returns the cause of the cancellation if the task is aborted before its inputs get ready.
+// A task whose inputs are already streaming when an upstream task fails is started anyway,
+// so that its workers finish reading the closed inputs and their errors are reported.
+func (tk *task) wait() error {
+	ctx := tk.parentContext()
+	select {
+	case <-tk.ready():
+		return nil
+	case <-ctx.Done():
+		cause := context.Cause(ctx)
+		if errors.Is(cause, ErrUpstreamFailed) && tk.isReady() {
+			return nil
+		}
+		return cause
+	}
+}
+
+// isReady returns true if all inputs are ready without waiting
+func (tk *task) isReady() bool {
+	for _, in := range tk.inputs {
+		select {
+		case <-in.Ready():
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// failedState returns the state of a failed task
+func (tk *task) failedState(started bool) TaskState {
+	cause := context.Cause(tk.parentContext())
+	switch {
+	case cause == nil:
+		return TaskFailed
+	case errors.Is(cause, ErrUpstreamFailed) && !started:
+		return TaskUpstreamFailed
+	default:
+		return TaskCanceled
+	}
+}
+
 func (tk *task) skip() error {
 	for _, out := range tk.outputs {
 		if err := out.Close(); err != nil {
@@ -109,15 +318,107 @@ func (tk *task) skip() error {
 	return nil
 }
 
+// run runs the processor and closes the outputs when it succeeds.
+// If the processor fails, it is retried up to maxAttempts times after the task is rolled back.
+// The outputs are left open when run returns an error.
 func (tk *task) run() error {
-	if err := tk.init(); err != nil {
-		return err
+	retryable := tk.maxAttempts > 1 && tk.isRetryable()
+	for {
+		tk.attempt()
+		err := tk.err()
+		if err == nil {
+			break
+		}
+		if !retryable || tk.attempts >= tk.maxAttempts {
+			return err
+		}
+		d := tk.backoff(tk.attempts)
+		Logger.Printf("Task '%v' failed at attempt %v: %v, retry after %v\n", tk.name, tk.attempts, err, d)
+		if err := tk.rollback(); err != nil {
+			tk.addError(err)
+			return tk.err()
+		}
+		select {
+		case <-time.After(d):
+		case <-tk.parentContext().Done():
+			tk.addError(context.Cause(tk.parentContext()))
+			return tk.err()
+		}
+		tk.clearErrors()
 	}
 	for _, out := range tk.outputs {
-		defer out.Close()
+		if err := out.Close(); err != nil {
+			tk.addError(err)
+		}
+	}
+	return tk.err()
+}
+
+// attempt runs the processor once.
+// If the workers do not return within the timeout, it returns without waiting for them.
+func (tk *task) attempt() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if tk.timeout > 0 {
+		ctx, cancel = context.WithTimeout(tk.parentContext(), tk.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(tk.parentContext())
+	}
+	defer cancel()
+	tk.mu.Lock()
+	tk.attempts++
+	tk.ctx = ctx
+	tk.mu.Unlock()
+	defer func() {
+		tk.mu.Lock()
+		tk.settled = tk.attempts
+		tk.mu.Unlock()
+	}()
+
+	done := tk.init(ctx)
+	select {
+	case <-done:
+		tk.addInputErrors()
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded && tk.parentContext().Err() == nil {
+			Logger.Printf("Task '%v' timed out after %v\n", tk.name, tk.timeout)
+			tk.addError(fmt.Errorf("%w after %v", ErrTimeout, tk.timeout))
+			return
+		}
+		cause := context.Cause(ctx)
+		tk.addError(cause)
+		if errors.Is(cause, ErrUpstreamFailed) {
+			// the failed task has closed the inputs, so the workers return soon and their errors are reported too
+			<-done
+		}
 	}
-	tk.wg.Wait()
-	return nil
+}
+
+// addInputErrors adds the errors which closed the inputs
+func (tk *task) addInputErrors() {
+	for _, in := range tk.inputs {
+		r, ok := unwrapOutput(in.(TaskInput)).(ErrReporter)
+		if !ok {
+			continue
+		}
+		if err := r.Err(); err != nil {
+			tk.addError(fmt.Errorf("failed to read %v: %w", in.String(), err))
+		}
+	}
+}
+
+func (tk *task) attemptCount() int {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return tk.attempts
+}
+
+func (tk *task) clearErrors() {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.errs = nil
 }
 
 func (tk *task) setDone() {
@@ -132,16 +433,56 @@ func (tk *task) Name() string {
 	return tk.name
 }
 
+func (tk *task) inputList() []Input {
+	return tk.inputs
+}
+
+func (tk *task) outputList() []Output {
+	return tk.outputs
+}
+
 func (tk *task) Requires() []Task {
 	return tk.requires
 }
 
+func (tk *task) Context() context.Context {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	if tk.ctx == nil {
+		return tk.parentContext()
+	}
+	return tk.ctx
+}
+
+func (tk *task) parentContext() context.Context {
+	if tk.parent == nil {
+		return context.Background()
+	}
+	return tk.parent
+}
+
+func (tk *task) setContext(ctx context.Context, abort context.CancelCauseFunc) {
+	tk.parent = ctx
+	tk.abort = abort
+}
+
 type options struct {
 	InitFunc     func() error
 	Inputs       []Input
 	Outputs      []Output
-	Processor    func(Task) error
+	Processor    func(context.Context, Task) error
 	WorkerNumber int
+	Resources    map[string]int
+	Timeout      time.Duration
+	MaxAttempts  int
+	Backoff      Backoff
+
+	ItemProcessor     ItemProcessor
+	Ordered           bool
+	ReorderBufferSize int
+
+	SortMergeJoin bool
+	HashJoin      bool
 }
 
 type Options func(*options)
@@ -149,6 +490,8 @@ type Options func(*options)
 func defaultOptions() *options {
 	return &options{
 		WorkerNumber: 1,
+		MaxAttempts:  1,
+		Backoff:      ConstantBackoff(0),
 	}
 }
 
@@ -165,6 +508,20 @@ func WithOutputs(outs ...Output) Options {
 }
 
 func WithProcessor(processor func(Task) error) Options {
+	return func(opts *options) {
+		if processor == nil {
+			opts.Processor = nil
+			return
+		}
+		opts.Processor = func(_ context.Context, tk Task) error {
+			return processor(tk)
+		}
+	}
+}
+
+// WithProcessorContext sets a processor which receives the context of the running flow.
+// The processor should return when the context is done.
+func WithProcessorContext(processor func(context.Context, Task) error) Options {
 	return func(opts *options) {
 		opts.Processor = processor
 	}
@@ -179,6 +536,70 @@ func WithWorker(workerNumber int) Options {
 	}
 }
 
+// WithResource declares that the task uses weight of the named resource pool while it runs.
+// The pool must be defined by WithResourcePool of the flow.
+func WithResource(name string, weight int) Options {
+	return func(opts *options) {
+		if opts.Resources == nil {
+			opts.Resources = map[string]int{}
+		}
+		if weight <= 0 {
+			weight = 1
+		}
+		opts.Resources[name] = weight
+	}
+}
+
+// WithTimeout fails the task if its workers do not return within d.
+// The context passed to the processor is canceled when the timeout expires.
+// If the task is retried, each attempt has its own timeout.
+func WithTimeout(d time.Duration) Options {
+	return func(opts *options) {
+		opts.Timeout = d
+	}
+}
+
+// Backoff returns the duration to wait before the next attempt.
+// attempt is the number of attempts which have failed so far.
+type Backoff func(attempt int) time.Duration
+
+// ConstantBackoff returns a Backoff which always waits d
+func ConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns a Backoff which waits base, base*2, base*4... up to max
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt; i++ {
+			d *= 2
+			if d >= max {
+				return max
+			}
+		}
+		return d
+	}
+}
+
+// WithRetry retries a failed processor up to maxAttempts times in total.
+// Before each retry, the outputs are destroyed and recreated, and the inputs are rewound,
+// so a task is retried only if all of its outputs implement Recreator and all of its inputs implement Rewinder.
+func WithRetry(maxAttempts int, backoff Backoff) Options {
+	return func(opts *options) {
+		if maxAttempts <= 0 {
+			maxAttempts = 1
+		}
+		if backoff == nil {
+			backoff = ConstantBackoff(0)
+		}
+		opts.MaxAttempts = maxAttempts
+		opts.Backoff = backoff
+	}
+}
+
 // NewTask returns a new task with specified input, output, processor
 func NewTask(name string, opts ...Options) Task {
 	op := defaultOptions()
@@ -190,20 +611,31 @@ func NewTask(name string, opts ...Options) Task {
 		processor:    op.Processor,
 		inputs:       op.Inputs,
 		workerNumber: op.WorkerNumber,
+		timeout:      op.Timeout,
+		resources:    op.Resources,
+		maxAttempts:  op.MaxAttempts,
+		backoff:      op.Backoff,
+		item:         op.ItemProcessor,
+		ordered:      op.Ordered,
+		hashJoin:     op.HashJoin,
+
+		reorderBufferSize: op.ReorderBufferSize,
 	}
 	for _, out := range op.Outputs {
 		tk.outputs = append(tk.outputs, &taskInput{
 			tk:     tk,
 			Output: out,
 		})
+		if b, ok := unwrapOutput(out).(taskBinder); ok {
+			b.bindTask(tk)
+		}
 	}
 	var requires []Task
 	for _, in := range op.Inputs {
 		for _, t := range in.(TaskInput).Tasks() {
-			// TODO use a better logic
 			found := false
 			for _, req := range requires {
-				if req.Name() == t.Name() {
+				if req.(*task) == t {
 					found = true
 					break
 				}
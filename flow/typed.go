@@ -0,0 +1,131 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnexpectedType is returned when a value of an unexpected type is written to or read from a typed output
+var ErrUnexpectedType = errors.New("unexpected type")
+
+// TypedOutput is an Output which accepts only values of T.
+// It can be passed to WithOutputs like any other Output, and the tasks can write and read it without type assertions
+// through Writer and Reader, so the compiler checks that the producer and the consumers agree on T.
+type TypedOutput[T any] struct {
+	Output
+}
+
+// NewTypedOutput wraps out so that only values of T can be written to it
+func NewTypedOutput[T any](out Output) *TypedOutput[T] {
+	return &TypedOutput[T]{Output: out}
+}
+
+// NewTypedChannelOutput returns a typed output backed by a ChannelOutput with the specified buffer size
+func NewTypedChannelOutput[T any](name string, size int) *TypedOutput[T] {
+	return NewTypedOutput[T](NewChannelOutput(name, make(chan interface{}, size)))
+}
+
+// Write returns ErrUnexpectedType if v is not a value of T
+func (to *TypedOutput[T]) Write(v interface{}) error {
+	if _, ok := v.(T); !ok {
+		return fmt.Errorf("%w: %T is written to %v", ErrUnexpectedType, v, to.String())
+	}
+	return to.Output.Write(v)
+}
+
+// Unwrap returns the wrapped output
+func (to *TypedOutput[T]) Unwrap() Output {
+	return to.Output
+}
+
+// Writer returns a writer of this output for tk, which must have this output in its outputs
+func (to *TypedOutput[T]) Writer(tk Task) *TypedWriter[T] {
+	for i, out := range tk.outputList() {
+		if out.(*taskInput).Output == Output(to) {
+			return &TypedWriter[T]{out: tk.Out(i)}
+		}
+	}
+	panic(fmt.Sprintf("%v is not an output of task '%v'", to.String(), tk.Name()))
+}
+
+// Reader returns a reader of this output for tk, which must have this output in its inputs
+func (to *TypedOutput[T]) Reader(tk Task) *TypedInput[T] {
+	for _, in := range tk.inputList() {
+		if ti, ok := in.(*taskInput); ok && ti.Output == Output(to) {
+			return &TypedInput[T]{tk: tk, in: in}
+		}
+	}
+	panic(fmt.Sprintf("%v is not an input of task '%v'", to.String(), tk.Name()))
+}
+
+// TypedWriter writes values of T to an output of a task
+type TypedWriter[T any] struct {
+	out Output
+}
+
+func (tw *TypedWriter[T]) Write(v T) error {
+	return tw.out.Write(v)
+}
+
+// Output returns the underlying output
+func (tw *TypedWriter[T]) Output() Output {
+	return tw.out
+}
+
+// TypedInput reads values of T from an input of a task
+type TypedInput[T any] struct {
+	tk  Task
+	in  Input
+	ch  chan T
+	err error
+}
+
+// Input returns the underlying input
+func (ti *TypedInput[T]) Input() Input {
+	return ti.in
+}
+
+// Read reads a value from the input
+func (ti *TypedInput[T]) Read() (T, error) {
+	var zero T
+	iv, err := ti.in.Read()
+	if err != nil {
+		return zero, err
+	}
+	v, ok := iv.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: %T is read from %v", ErrUnexpectedType, iv, ti.in.String())
+	}
+	return v, nil
+}
+
+// Channel returns a channel which receives the values of the input.
+// The channel is closed when the input is closed or a value of an unexpected type is read, which is reported by Err.
+func (ti *TypedInput[T]) Channel() <-chan T {
+	if ti.ch != nil {
+		return ti.ch
+	}
+	ti.ch = make(chan T)
+	ctx := ti.tk.Context()
+	go func(ch chan T) {
+		defer close(ch)
+		for iv := range ti.in.Channel() {
+			v, ok := iv.(T)
+			if !ok {
+				ti.err = fmt.Errorf("%w: %T is read from %v", ErrUnexpectedType, iv, ti.in.String())
+				return
+			}
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(ti.ch)
+	return ti.ch
+}
+
+// Err returns the error which closed the channel returned by Channel
+func (ti *TypedInput[T]) Err() error {
+	return ti.err
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -22,45 +23,128 @@ type Line struct {
 }
 
 type tail struct {
-	r     io.ReadCloser
-	br    *bufio.Reader
-	Lines chan *Line
-	done  chan bool
+	r        io.ReadCloser
+	split    bufio.SplitFunc
+	Lines    chan *Line
+	done     chan bool
+	canceled chan struct{}
+
+	stopOnce   sync.Once
+	cancelOnce sync.Once
 }
 
-func newTail(r io.ReadCloser) *tail {
+// newTail returns a tail which splits the stream into records by split, or into lines if split is nil
+func newTail(r io.ReadCloser, split bufio.SplitFunc) *tail {
+	if split == nil {
+		split = bufio.ScanLines
+	}
 	t := &tail{
-		r:     r,
-		br:    bufio.NewReader(r),
-		Lines: make(chan *Line),
-		done:  make(chan bool),
+		r:        r,
+		split:    split,
+		Lines:    make(chan *Line),
+		done:     make(chan bool),
+		canceled: make(chan struct{}),
 	}
 	return t
 }
 
+// newFileTail opens the file and starts tailing it
+func newFileTail(path string, split bufio.SplitFunc) (*tail, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := newTail(r, split)
+	go t.Run()
+	return t, nil
+}
+
+// Run reads records until EOF is reached after Stop is called.
+// A record which is not terminated yet is kept until the rest of it is written.
+// Lines is closed when Run returns.
 func (t *tail) Run() {
+	defer t.r.Close()
+	defer close(t.Lines)
 	poll := time.NewTicker(TailPollInterval)
 	defer poll.Stop()
+	var (
+		buf   []byte
+		chunk = make([]byte, 32*1024)
+		stop  bool
+	)
 	for {
-		line, _, err := t.br.ReadLine()
+		n, err := t.r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil && err != io.EOF {
+			t.send(&Line{Error: err})
+			return
+		}
+		atEOF := err == io.EOF && stop
+		var ok bool
+		if buf, ok = t.sendRecords(buf, atEOF); !ok {
+			return
+		}
+		if atEOF {
+			t.send(&Line{Error: io.EOF})
+			return
+		}
 		if err == io.EOF {
 			select {
 			case <-t.done:
-				line, _, err = t.br.ReadLine()
-				if err == io.EOF {
-					t.Lines <- &Line{Text: line, Error: err}
-					return
-				}
+				// read the rest which was written before Stop
+				stop = true
 			case <-poll.C:
-				continue
+			case <-t.canceled:
+				return
 			}
 		}
-		t.Lines <- &Line{Text: line, Error: err}
 	}
 }
 
+// sendRecords sends the complete records in buf and returns the remaining bytes
+func (t *tail) sendRecords(buf []byte, atEOF bool) ([]byte, bool) {
+	for len(buf) > 0 {
+		advance, token, err := t.split(buf, atEOF)
+		if err != nil {
+			t.send(&Line{Error: err})
+			return nil, false
+		}
+		if advance == 0 && token == nil {
+			break
+		}
+		buf = buf[advance:]
+		if token == nil {
+			continue
+		}
+		// the token is a slice of buf which is overwritten by the next read
+		if !t.send(&Line{Text: append([]byte{}, token...)}) {
+			return nil, false
+		}
+	}
+	return buf, true
+}
+
+func (t *tail) send(line *Line) bool {
+	select {
+	case t.Lines <- line:
+		return true
+	case <-t.canceled:
+		return false
+	}
+}
+
+// Stop tells the tail that no more records will be written
 func (t *tail) Stop() {
-	close(t.done)
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+// Cancel stops the tail immediately
+func (t *tail) Cancel() {
+	t.cancelOnce.Do(func() {
+		close(t.canceled)
+	})
 }
 
 func IsFileExists(path string) bool {
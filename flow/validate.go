@@ -0,0 +1,306 @@
+package flow
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError is returned by Flow.Validate and holds all problems found in a flow
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid flow: %v", strings.Join(msgs, ", "))
+}
+
+// Unwrap returns each problem so that errors.As can inspect them
+func (e *ValidationError) Unwrap() []error {
+	return e.Errors
+}
+
+// CycleError means the tasks depend on each other
+type CycleError struct {
+	Tasks []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %v", strings.Join(e.Tasks, " => "))
+}
+
+// DuplicateTaskError means distinct tasks have the same name
+type DuplicateTaskError struct {
+	Name string
+}
+
+func (e *DuplicateTaskError) Error() string {
+	return fmt.Sprintf("duplicate task name: '%v'", e.Name)
+}
+
+// NoProcessorError means the task has no processor
+type NoProcessorError struct {
+	Task string
+}
+
+func (e *NoProcessorError) Error() string {
+	return fmt.Sprintf("task '%v' has no processor", e.Task)
+}
+
+// SharedOutputError means an output is consumed more than once
+type SharedOutputError struct {
+	Output string
+	Tasks  []string
+}
+
+func (e *SharedOutputError) Error() string {
+	return fmt.Sprintf("output %v is consumed by more than one task: %v", e.Output, strings.Join(e.Tasks, ", "))
+}
+
+// OrderError means a task has WithOrder and multiple workers, but no item processor which the order is kept by
+type OrderError struct {
+	Task    string
+	Workers int
+}
+
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("task '%v' cannot keep the order by %v workers without an item processor", e.Task, e.Workers)
+}
+
+// JoinError means both inputs of a hash join built by Join are streamed from Upstream.
+// The join reads all values of the right input before the left one, so Upstream blocks on writing the left input.
+type JoinError struct {
+	Task     string
+	Upstream string
+}
+
+func (e *JoinError) Error() string {
+	return fmt.Sprintf("task '%v' reads its right input before its left input, but both are streamed from task '%v'", e.Task, e.Upstream)
+}
+
+// ConsumerError means consumers of a BroadcastOutput are not an input of any task, which blocks the writer forever
+type ConsumerError struct {
+	Output    string
+	Consumers []int
+}
+
+func (e *ConsumerError) Error() string {
+	return fmt.Sprintf("consumers %v of output %v are read by no task", e.Consumers, e.Output)
+}
+
+// PartitionError means partitions of a PartitionedOutput may have no reader, which blocks the writer forever.
+// If Task is empty, the partitions are not an input of any task.
+// Otherwise, Task reads them with fewer workers than the partitions it reads.
+type PartitionError struct {
+	Output     string
+	Partitions []int
+	Task       string
+	Workers    int
+}
+
+func (e *PartitionError) Error() string {
+	if e.Task == "" {
+		return fmt.Sprintf("partitions %v of output %v are read by no task", e.Partitions, e.Output)
+	}
+	return fmt.Sprintf("task '%v' reads partitions %v of output %v by %v worker(s)", e.Task, e.Partitions, e.Output, e.Workers)
+}
+
+// Validate checks that the flow has no dependency cycle, no duplicate task name, no task without a processor,
+// no output which is consumed by more than one task, no consumer or partition which has no reader,
+// no task which cannot keep the order set by WithOrder, and no hash join whose inputs are streamed from the same task.
+// It returns a *ValidationError which holds all problems found.
+func (fl *Flow) Validate() error {
+	var (
+		errs      []error
+		tasks     []*task
+		state     = map[*task]int{} // 1: visiting, 2: visited
+		path      []*task
+		consumers = map[Output][]*task{}
+		outputs   []Output
+		visit     func(tk *task)
+	)
+	visit = func(tk *task) {
+		switch state[tk] {
+		case 1:
+			// the cycle starts from the first occurrence of tk in the path
+			var cycle []string
+			for i := len(path) - 1; i >= 0; i-- {
+				if path[i] == tk {
+					for _, t := range path[i:] {
+						cycle = append(cycle, t.Name())
+					}
+					break
+				}
+			}
+			errs = append(errs, &CycleError{Tasks: append(cycle, tk.Name())})
+			return
+		case 2:
+			return
+		}
+		state[tk] = 1
+		path = append(path, tk)
+		for _, in := range tk.inputs {
+			for _, dep := range resolveDependentInputs(in) {
+				out := dep.(Output)
+				if _, ok := consumers[out]; !ok {
+					outputs = append(outputs, out)
+				}
+				if !containsTask(consumers[out], tk) {
+					consumers[out] = append(consumers[out], tk)
+				}
+			}
+			for _, parent := range in.(TaskInput).Tasks() {
+				visit(parent)
+			}
+		}
+		path = path[:len(path)-1]
+		state[tk] = 2
+		tasks = append(tasks, tk)
+	}
+	visit(fl.entry.(*task))
+
+	names := map[string]*task{}
+	for _, tk := range tasks {
+		if other, ok := names[tk.Name()]; ok && other != tk {
+			errs = append(errs, &DuplicateTaskError{Name: tk.Name()})
+		}
+		names[tk.Name()] = tk
+		if tk.processor == nil && tk.item == nil {
+			errs = append(errs, &NoProcessorError{Task: tk.Name()})
+		}
+		if tk.ordered && tk.item == nil && tk.workerNumber > 1 {
+			errs = append(errs, &OrderError{Task: tk.Name(), Workers: tk.workerNumber})
+		}
+		errs = append(errs, partitionErrors(tk, consumers)...)
+		if err := joinError(tk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, out := range outputs {
+		if len(consumers[out]) > 1 {
+			var names []string
+			for _, tk := range consumers[out] {
+				names = append(names, tk.Name())
+			}
+			errs = append(errs, &SharedOutputError{Output: out.String(), Tasks: names})
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// partitionErrors checks that each consumer of a BroadcastOutput or a PartitionedOutput written by tk is read by a task,
+// and that tk has a worker for each partition it reads separately, not through CombineInputs
+func partitionErrors(tk *task, consumers map[Output][]*task) []error {
+	var errs []error
+	for _, out := range tk.outputs {
+		var inputs []Input
+		switch o := unwrapOutput(out).(type) {
+		case *BroadcastOutput:
+			inputs = o.inputs
+		case *PartitionedOutput:
+			inputs = o.inputs
+		default:
+			continue
+		}
+		var unread []int
+		for i, in := range inputs {
+			if len(consumers[in.(Output)]) == 0 {
+				unread = append(unread, i)
+			}
+		}
+		if len(unread) == 0 {
+			continue
+		}
+		if _, ok := unwrapOutput(out).(*PartitionedOutput); ok {
+			errs = append(errs, &PartitionError{Output: out.String(), Partitions: unread})
+		} else {
+			errs = append(errs, &ConsumerError{Output: out.String(), Consumers: unread})
+		}
+	}
+	var (
+		pos  []*PartitionedOutput
+		read = map[*PartitionedOutput][]int{}
+	)
+	for _, in := range tk.inputs {
+		// the partitions of a combined input are read together by one worker
+		ti, ok := in.(*taskInput)
+		if !ok {
+			continue
+		}
+		c, ok := unwrapOutput(ti).(*consumerOutput)
+		if !ok {
+			continue
+		}
+		po, ok := c.parent.(*PartitionedOutput)
+		if !ok {
+			continue
+		}
+		if _, ok := read[po]; !ok {
+			pos = append(pos, po)
+		}
+		read[po] = append(read[po], c.idx)
+	}
+	for _, po := range pos {
+		if len(read[po]) > 1 && len(read[po]) > tk.workerNumber {
+			errs = append(errs, &PartitionError{Output: po.String(), Partitions: read[po], Task: tk.Name(), Workers: tk.workerNumber})
+		}
+	}
+	return errs
+}
+
+func containsTask(tasks []*task, tk *task) bool {
+	for _, t := range tasks {
+		if t == tk {
+			return true
+		}
+	}
+	return false
+}
+
+// joinError checks that the inputs of a hash join are not streamed from the same task
+func joinError(tk *task) error {
+	if !tk.hashJoin || len(tk.inputs) < 2 {
+		return nil
+	}
+	left := map[*task]bool{}
+	for _, t := range streamingTasks(tk.inputs[0]) {
+		left[t] = true
+	}
+	for _, t := range streamingTasks(tk.inputs[1]) {
+		if left[t] {
+			return &JoinError{Task: tk.Name(), Upstream: t.Name()}
+		}
+	}
+	return nil
+}
+
+// streamingTasks returns the tasks which stream values to in, directly or through other tasks.
+// An output which is not ready before its task runs, such as FileOutput, is not streamed.
+func streamingTasks(in Input) []*task {
+	var (
+		tasks []*task
+		found = map[*task]bool{}
+		visit func(in Input)
+	)
+	visit = func(in Input) {
+		for _, dep := range resolveDependentInputs(in) {
+			ti := dep.(*taskInput)
+			if found[ti.tk] || ti.tk.isSkip() || !isClosed(ti.Ready()) {
+				continue
+			}
+			found[ti.tk] = true
+			tasks = append(tasks, ti.tk)
+			for _, in := range ti.tk.inputs {
+				visit(in)
+			}
+		}
+	}
+	visit(in)
+	return tasks
+}